@@ -0,0 +1,93 @@
+package dynatrace
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Agent describes the OneAgent installed by the hook.
+type Agent struct {
+	// Dir is the directory OneAgent was installed to.
+	Dir string
+
+	Version string
+
+	// Library is the path of the agent library to preload on Linux. It's empty for other platforms.
+	Library string
+
+	// Env holds the variables OneAgent needs at runtime, from the installer and the service credentials. Variables
+	// whose value is only known when the app starts are left out.
+	Env []EnvVar
+}
+
+// EnvVar is an environment variable.
+type EnvVar struct {
+	Name  string
+	Value string
+}
+
+func newAgent(stager Stager, report *stagingReport) (*Agent, error) {
+	agent := &Agent{
+		Dir:     filepath.Join(installRoot(stager), "dynatrace", "oneagent"),
+		Version: report.AgentVersion,
+	}
+	if report.AgentLibrary != "" {
+		agent.Library = filepath.Join(installRoot(stager), filepath.FromSlash(report.AgentLibrary))
+	}
+
+	env, err := readEnvScript(filepath.Join(agent.Dir, "dynatrace-env.sh"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, v := range report.Environment {
+		if v.Name != "LD_PRELOAD" && !strings.Contains(v.Value, "${") {
+			env = append(env, EnvVar{Name: v.Name, Value: v.Value})
+		}
+	}
+	agent.Env = env
+
+	return agent, nil
+}
+
+// readEnvScript reads the variables exported by a script like the installer's dynatrace-env.sh. Only plain
+// assignments are supported.
+func readEnvScript(path string) ([]EnvVar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []EnvVar
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "export ") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "export ")), "=")
+		if !ok {
+			continue
+		}
+
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		} else {
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			// Values referencing other variables can't be resolved here.
+			if strings.Contains(strings.ReplaceAll(value, `\$`, ""), "$") {
+				continue
+			}
+			value = shellUnquote(value)
+		}
+		env = append(env, EnvVar{Name: name, Value: value})
+	}
+
+	return env, scanner.Err()
+}
@@ -0,0 +1,246 @@
+package dynatrace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// agentConfig represents the content of a ruxitagentproc.conf file. The file consists of sections ('[section]'),
+// each holding properties as 'key value' lines, plus comments and blank lines.
+//
+// We keep every line as it was read, so that writing an unchanged config gives back the original content byte for
+// byte. Properties are only rewritten when they change, new properties are appended to the end of their section, and
+// new sections to the end of the file.
+type agentConfig struct {
+	lines []agentConfigLine
+
+	// trailingNewline is set if the last line of the file was terminated by a newline.
+	trailingNewline bool
+}
+
+type agentConfigLineKind int
+
+const (
+	agentConfigOther agentConfigLineKind = iota // Comments, blank lines and anything we don't understand.
+	agentConfigSection
+	agentConfigProperty
+)
+
+type agentConfigLine struct {
+	raw     string
+	kind    agentConfigLineKind
+	section string
+	key     string
+	value   string
+}
+
+// parseAgentConfig reads a ruxitagentproc.conf file.
+func parseAgentConfig(r io.Reader) (*agentConfig, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &agentConfig{trailingNewline: true}
+	if len(raw) == 0 {
+		return c, nil
+	}
+
+	content := string(raw)
+	if strings.HasSuffix(content, "\n") {
+		content = strings.TrimSuffix(content, "\n")
+	} else {
+		c.trailingNewline = false
+	}
+
+	currentSection := ""
+	for _, raw := range strings.Split(content, "\n") {
+		line := agentConfigLine{raw: raw, section: currentSection}
+		trimmed := strings.TrimSpace(raw)
+
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			line.kind = agentConfigOther
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			line.kind = agentConfigSection
+			currentSection = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			line.section = currentSection
+		default:
+			// Values may contain anything, including spaces, '[' or '#', so everything after the key is the value.
+			line.kind = agentConfigProperty
+			line.key = trimmed
+			if i := strings.IndexAny(trimmed, " \t"); i != -1 {
+				line.key, line.value = trimmed[:i], strings.TrimSpace(trimmed[i+1:])
+			}
+		}
+
+		c.lines = append(c.lines, line)
+	}
+
+	return c, nil
+}
+
+// Get returns the value of a property. If the key is defined more than once, the last definition wins.
+func (c *agentConfig) Get(section, key string) (string, bool) {
+	for i := len(c.lines) - 1; i >= 0; i-- {
+		if l := c.lines[i]; l.kind == agentConfigProperty && l.section == section && l.key == key {
+			return l.value, true
+		}
+	}
+	return "", false
+}
+
+// Set changes the value of a property, adding it if needed. Earlier duplicates of a changed key are removed, so that
+// the value is unambiguous afterwards.
+func (c *agentConfig) Set(section, key, value string) {
+	if current, ok := c.Get(section, key); ok && current == value {
+		return
+	}
+
+	last := -1
+	for i, l := range c.lines {
+		if l.kind == agentConfigProperty && l.section == section && l.key == key {
+			last = i
+		}
+	}
+
+	line := agentConfigLine{raw: formatAgentConfigProperty(key, value), kind: agentConfigProperty, section: section, key: key, value: value}
+
+	if last != -1 {
+		c.lines[last] = line
+		c.removeIf(func(i int, l agentConfigLine) bool {
+			return i < last && l.kind == agentConfigProperty && l.section == section && l.key == key
+		})
+		return
+	}
+
+	// Append the property right after the last property or header of the section.
+	insertAt := -1
+	for i, l := range c.lines {
+		if l.section == section && (l.kind == agentConfigProperty || l.kind == agentConfigSection) {
+			insertAt = i + 1
+		}
+	}
+
+	if insertAt == -1 && section == "" {
+		insertAt = 0 // Properties without section belong before the first section.
+	}
+
+	if insertAt == -1 {
+		if len(c.lines) > 0 && strings.TrimSpace(c.lines[len(c.lines)-1].raw) != "" {
+			c.lines = append(c.lines, agentConfigLine{kind: agentConfigOther, section: c.lines[len(c.lines)-1].section})
+		}
+		c.lines = append(c.lines, agentConfigLine{raw: "[" + section + "]", kind: agentConfigSection, section: section})
+		insertAt = len(c.lines)
+	}
+
+	c.lines = append(c.lines[:insertAt], append([]agentConfigLine{line}, c.lines[insertAt:]...)...)
+}
+
+// Delete removes every definition of a property. It returns false if the property didn't exist.
+func (c *agentConfig) Delete(section, key string) bool {
+	return c.removeIf(func(_ int, l agentConfigLine) bool {
+		return l.kind == agentConfigProperty && l.section == section && l.key == key
+	})
+}
+
+func (c *agentConfig) removeIf(remove func(int, agentConfigLine) bool) bool {
+	kept := c.lines[:0]
+	removed := false
+	for i, l := range c.lines {
+		if remove(i, l) {
+			removed = true
+			continue
+		}
+		kept = append(kept, l)
+	}
+	c.lines = kept
+	return removed
+}
+
+// WriteTo writes the config in the ruxitagentproc.conf format.
+func (c *agentConfig) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	for i, l := range c.lines {
+		sb.WriteString(l.raw)
+		if i < len(c.lines)-1 || c.trailingNewline {
+			sb.WriteString("\n")
+		}
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func formatAgentConfigProperty(key, value string) string {
+	if value == "" {
+		return key
+	}
+	return key + " " + value
+}
+
+// agentConfigOverride is a property set through the agentconfig credential. A nil value removes the property.
+type agentConfigOverride struct {
+	section string
+	key     string
+	value   *string
+}
+
+// parseAgentConfigOverrides reads the agentconfig credential, a JSON object of section -> key -> value. It may be given
+// as object, or as string holding the JSON, e.g. when read from a service binding file. The overrides are returned
+// sorted by section and key, so that they are applied and logged in a predictable order.
+func parseAgentConfigOverrides(raw interface{}) ([]agentConfigOverride, error) {
+	if s, ok := raw.(string); ok {
+		if strings.TrimSpace(s) == "" {
+			return nil, nil
+		}
+		if err := json.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, fmt.Errorf("invalid agentconfig: %s", err)
+		}
+	}
+
+	if raw == nil {
+		return nil, nil
+	}
+
+	sections, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid agentconfig: expected an object of sections")
+	}
+
+	var overrides []agentConfigOverride
+	for section, rawProperties := range sections {
+		properties, ok := rawProperties.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid agentconfig: expected an object of properties for section '%s'", section)
+		}
+
+		for key, rawValue := range properties {
+			override := agentConfigOverride{section: section, key: key}
+			switch v := rawValue.(type) {
+			case nil:
+			case string:
+				override.value = &v
+			case bool, float64:
+				value := fmt.Sprint(v)
+				override.value = &value
+			default:
+				return nil, fmt.Errorf("invalid agentconfig: unsupported value for '%s' in section '%s'", key, section)
+			}
+			overrides = append(overrides, override)
+		}
+	}
+
+	sort.Slice(overrides, func(i, j int) bool {
+		if overrides[i].section != overrides[j].section {
+			return overrides[i].section < overrides[j].section
+		}
+		return overrides[i].key < overrides[j].key
+	})
+
+	return overrides, nil
+}
@@ -0,0 +1,101 @@
+package dynatrace
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("agentConfig", func() {
+	const original = `# Generated by the installer
+
+[general]
+key1 value1
+# with a comment inside the section
+key2 value with [brackets] and # hash
+
+[section2]
+key3 val3
+key3 val3-duplicate
+`
+
+	roundTrip := func(c *agentConfig) string {
+		var buf bytes.Buffer
+		_, err := c.WriteTo(&buf)
+		Expect(err).To(BeNil())
+		return buf.String()
+	}
+
+	parse := func(content string) *agentConfig {
+		c, err := parseAgentConfig(strings.NewReader(content))
+		Expect(err).To(BeNil())
+		return c
+	}
+
+	It("round-trips unchanged files byte for byte", func() {
+		Expect(roundTrip(parse(original))).To(Equal(original))
+		Expect(roundTrip(parse("[a]\r\nkey value\r\n\r\n"))).To(Equal("[a]\r\nkey value\r\n\r\n"))
+		Expect(roundTrip(parse("[a]\nkey value"))).To(Equal("[a]\nkey value"))
+	})
+
+	It("parses values containing brackets and hashes", func() {
+		c := parse(original)
+
+		value, ok := c.Get("general", "key2")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("value with [brackets] and # hash"))
+
+		_, ok = c.Get("value with [brackets] and # hash", "key3")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("lets the last duplicate win", func() {
+		value, ok := parse(original).Get("section2", "key3")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("val3-duplicate"))
+	})
+
+	It("keeps the file unchanged when setting current values", func() {
+		c := parse(original)
+		c.Set("general", "key1", "value1")
+		c.Set("section2", "key3", "val3-duplicate")
+		Expect(roundTrip(c)).To(Equal(original))
+	})
+
+	It("updates properties in place and appends new ones predictably", func() {
+		c := parse(original)
+		c.Set("general", "key1", "updated")
+		c.Set("general", "key4", "new")
+		c.Set("section2", "key3", "deduplicated")
+		c.Set("section3", "key5", "val5")
+		c.Set("section3", "key6", "val6")
+
+		Expect(roundTrip(c)).To(Equal(`# Generated by the installer
+
+[general]
+key1 updated
+# with a comment inside the section
+key2 value with [brackets] and # hash
+key4 new
+
+[section2]
+key3 deduplicated
+
+[section3]
+key5 val5
+key6 val6
+`))
+	})
+
+	It("deletes all definitions of a property", func() {
+		c := parse(original)
+		Expect(c.Delete("section2", "key3")).To(BeTrue())
+		Expect(c.Delete("section2", "key3")).To(BeFalse())
+
+		_, ok := c.Get("section2", "key3")
+		Expect(ok).To(BeFalse())
+		Expect(roundTrip(c)).To(HaveSuffix("[section2]\n"))
+	})
+})
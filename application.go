@@ -0,0 +1,32 @@
+package dynatrace
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// vcapApplication represents the fields we use from the VCAP_APPLICATION environment variable, which describes the
+// app being staged.
+type vcapApplication struct {
+	ApplicationID      string `json:"application_id"`
+	ApplicationName    string `json:"application_name"`
+	ApplicationVersion string `json:"application_version"`
+	SpaceID            string `json:"space_id"`
+	SpaceName          string `json:"space_name"`
+	OrganizationID     string `json:"organization_id"`
+	OrganizationName   string `json:"organization_name"`
+	Name               string `json:"name"`
+}
+
+// getVCAPApplication parses VCAP_APPLICATION. Missing or malformed data results in empty fields.
+func (h *Hook) getVCAPApplication() vcapApplication {
+	var app vcapApplication
+	if err := json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &app); err != nil {
+		h.Log.Debug("Failed to unmarshal VCAP_APPLICATION: %s", err)
+	}
+
+	if app.ApplicationName == "" {
+		app.ApplicationName = app.Name
+	}
+	return app
+}
@@ -0,0 +1,242 @@
+package dynatrace
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultMaxExtractedSize  = 4 << 30 // 4 GiB
+	defaultMaxExtractedFiles = 50000
+)
+
+// archiveGuard checks the entries of an archive before they are extracted to targetDir. Entries must neither escape
+// targetDir, through '..' or absolute names, nor be placed or linked through a symbolic link of the archive, which
+// could point anywhere once created.
+type archiveGuard struct {
+	targetDir string
+	symlinks  map[string]bool
+}
+
+func newArchiveGuard(targetDir string) *archiveGuard {
+	return &archiveGuard{targetDir: filepath.Clean(targetDir), symlinks: map[string]bool{}}
+}
+
+// path returns where the entry name is extracted to.
+func (g *archiveGuard) path(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		(len(name) > 1 && name[1] == ':') {
+		return "", fmt.Errorf("illegal path '%s' in archive", name)
+	}
+
+	resolved, ok := g.resolve(splitArchivePath(name))
+	if !ok || resolved == "" {
+		return "", fmt.Errorf("illegal path '%s' in archive", name)
+	}
+
+	return filepath.Join(g.targetDir, filepath.FromSlash(resolved)), nil
+}
+
+// link checks a link from the entry name to linkname. Symbolic links are relative to the link's directory, hard links
+// to the root of the archive. Symbolic links are remembered, so that no later entry is placed beneath them.
+func (g *archiveGuard) link(name, linkname string, symbolic bool) error {
+	if _, err := g.path(name); err != nil {
+		return err
+	}
+
+	if linkname == "" || strings.HasPrefix(linkname, "/") || strings.HasPrefix(linkname, `\`) || filepath.IsAbs(linkname) {
+		return fmt.Errorf("illegal link '%s' -> '%s' in archive", name, linkname)
+	}
+
+	parts := splitArchivePath(linkname)
+	if symbolic {
+		dir := splitArchivePath(name)
+		parts = append(dir[:len(dir)-1], parts...)
+	}
+
+	if _, ok := g.resolve(parts); !ok {
+		return fmt.Errorf("illegal link '%s' -> '%s' in archive", name, linkname)
+	}
+
+	if symbolic {
+		resolved, _ := g.resolve(splitArchivePath(name))
+		g.symlinks[resolved] = true
+	}
+	return nil
+}
+
+// resolve walks the path elements from the root of the archive. It fails if the path leaves the root, or continues
+// beneath a symbolic link.
+func (g *archiveGuard) resolve(parts []string) (string, bool) {
+	var stack []string
+	for i, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) == 0 {
+				return "", false
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			stack = append(stack, part)
+			if i < len(parts)-1 && g.symlinks[strings.Join(stack, "/")] {
+				return "", false
+			}
+		}
+	}
+	return strings.Join(stack, "/"), true
+}
+
+// splitArchivePath splits an entry name into its elements. Both separators are accepted, since archives created on
+// Windows may use backslashes.
+func splitArchivePath(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' })
+}
+
+// writeArchiveFile writes an extracted file. An existing file or link at target is replaced, not written through.
+func writeArchiveFile(target string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// extractLimits returns the maximum total size and number of files extracted from an installer archive.
+func (h *Hook) extractLimits() (int64, int) {
+	maxSize, maxFiles := h.MaxExtractedSize, h.MaxExtractedFiles
+	if maxSize <= 0 {
+		maxSize = defaultMaxExtractedSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultMaxExtractedFiles
+	}
+	return maxSize, maxFiles
+}
+
+// extractZip extracts the zip archive to targetDir. Every entry is checked before anything is written, and the archive
+// is extracted into a temporary directory next to targetDir, which is only renamed into place once everything was
+// extracted, so that a failure never leaves a partially extracted OneAgent behind.
+func (h *Hook) extractZip(zipPath, targetDir string) error {
+	maxSize, maxFiles := h.extractLimits()
+
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if len(r.File) > maxFiles {
+		return fmt.Errorf("archive has %d entries, more than the limit of %d", len(r.File), maxFiles)
+	}
+
+	// The sizes declared in the archive may be wrong, so they are checked again while extracting.
+	guard := newArchiveGuard(targetDir)
+	var declaredSize uint64
+	for _, f := range r.File {
+		if _, err := guard.path(f.Name); err != nil {
+			return err
+		}
+		if mode := f.Mode(); mode&os.ModeType != 0 && !mode.IsDir() {
+			return fmt.Errorf("unsupported entry type for '%s' in archive", f.Name)
+		}
+		declaredSize += f.UncompressedSize64
+	}
+	if declaredSize > uint64(maxSize) {
+		return fmt.Errorf("archive extracts to %d bytes, more than the limit of %d", declaredSize, maxSize)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetDir), 0755); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(targetDir), "."+filepath.Base(targetDir)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpGuard := newArchiveGuard(tmpDir)
+	remaining := maxSize
+	for _, f := range r.File {
+		target, err := tmpGuard.path(f.Name)
+		if err != nil {
+			return err
+		}
+
+		if f.Mode().IsDir() || strings.HasSuffix(f.Name, "/") {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if remaining, err = extractZipFile(f, target, remaining); err != nil {
+			return err
+		}
+	}
+
+	return replaceDir(tmpDir, targetDir)
+}
+
+// extractZipFile writes a file from the archive, failing if more than remaining bytes are written. It returns how many
+// bytes may still be written.
+func extractZipFile(f *zip.File, target string, remaining int64) (int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	perm := f.Mode().Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+
+	limited := &io.LimitedReader{R: rc, N: remaining + 1}
+	if err := writeArchiveFile(target, limited, perm); err != nil {
+		return 0, err
+	}
+	if limited.N == 0 {
+		return 0, errors.New("archive extracts to more than the size limit")
+	}
+
+	return limited.N - 1, nil
+}
+
+// replaceDir moves src to dst. An existing dst is only removed once src is in place.
+func replaceDir(src, dst string) error {
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return os.Rename(src, dst)
+	}
+
+	old := src + ".old"
+	if err := os.Rename(dst, old); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		os.Rename(old, dst)
+		return err
+	}
+	return os.RemoveAll(old)
+}
@@ -0,0 +1,132 @@
+package dynatrace
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("extractZip", func() {
+	var (
+		hook      *Hook
+		tmpDir    string
+		zipPath   string
+		targetDir string
+	)
+
+	type entry struct {
+		name string
+		body string
+		mode os.FileMode
+	}
+
+	writeZip := func(entries ...entry) {
+		f, err := os.Create(zipPath)
+		Expect(err).To(BeNil())
+		defer f.Close()
+
+		zw := zip.NewWriter(f)
+		for _, e := range entries {
+			hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+			if e.mode != 0 {
+				hdr.SetMode(e.mode)
+			}
+			w, err := zw.CreateHeader(hdr)
+			Expect(err).To(BeNil())
+			_, err = w.Write([]byte(e.body))
+			Expect(err).To(BeNil())
+		}
+		Expect(zw.Close()).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "libbuildpack-dynatrace.zip.")
+		Expect(err).To(BeNil())
+
+		hook = &Hook{}
+		zipPath = filepath.Join(tmpDir, "paasInstaller.zip")
+		targetDir = filepath.Join(tmpDir, "app", "dynatrace", "oneagent")
+		Expect(os.MkdirAll(filepath.Dir(targetDir), 0755)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	expectNothingExtracted := func() {
+		entries, err := os.ReadDir(filepath.Dir(targetDir))
+		Expect(err).To(BeNil())
+		Expect(entries).To(BeEmpty())
+	}
+
+	It("extracts the archive", func() {
+		writeZip(
+			entry{name: "manifest.json", body: "{}"},
+			entry{name: "agent/", mode: os.ModeDir | 0755},
+			entry{name: "agent/bin/windows-x86-64/oneagentloader.dll", body: "loader"})
+
+		Expect(hook.extractZip(zipPath, targetDir)).To(Succeed())
+
+		contents, err := os.ReadFile(filepath.Join(targetDir, "agent", "bin", "windows-x86-64", "oneagentloader.dll"))
+		Expect(err).To(BeNil())
+		Expect(string(contents)).To(Equal("loader"))
+
+		entries, err := os.ReadDir(filepath.Dir(targetDir))
+		Expect(err).To(BeNil())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("replaces an existing directory", func() {
+		Expect(os.MkdirAll(targetDir, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(targetDir, "stale"), nil, 0644)).To(Succeed())
+		writeZip(entry{name: "manifest.json", body: "{}"})
+
+		Expect(hook.extractZip(zipPath, targetDir)).To(Succeed())
+
+		_, err := os.Stat(filepath.Join(targetDir, "stale"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		_, err = os.Stat(filepath.Join(targetDir, "manifest.json"))
+		Expect(err).To(BeNil())
+	})
+
+	It("rejects entries escaping the target directory", func() {
+		writeZip(entry{name: "manifest.json", body: "{}"}, entry{name: `agent\..\..\..\evil.dll`, body: "evil"})
+
+		Expect(hook.extractZip(zipPath, targetDir)).To(MatchError(ContainSubstring("illegal path")))
+		expectNothingExtracted()
+	})
+
+	It("rejects absolute paths", func() {
+		writeZip(entry{name: "/etc/evil", body: "evil"})
+		Expect(hook.extractZip(zipPath, targetDir)).To(MatchError(ContainSubstring("illegal path")))
+
+		writeZip(entry{name: `C:\Windows\evil.dll`, body: "evil"})
+		Expect(hook.extractZip(zipPath, targetDir)).To(MatchError(ContainSubstring("illegal path")))
+	})
+
+	It("rejects symbolic links", func() {
+		writeZip(entry{name: "agent/link", body: "/etc/passwd", mode: os.ModeSymlink | 0777})
+
+		Expect(hook.extractZip(zipPath, targetDir)).To(MatchError(ContainSubstring("unsupported entry type")))
+		expectNothingExtracted()
+	})
+
+	It("enforces the file count limit", func() {
+		hook.MaxExtractedFiles = 2
+		writeZip(entry{name: "a"}, entry{name: "b"}, entry{name: "c"})
+
+		Expect(hook.extractZip(zipPath, targetDir)).To(MatchError(ContainSubstring("more than the limit of 2")))
+	})
+
+	It("enforces the size limit", func() {
+		hook.MaxExtractedSize = 10
+		writeZip(entry{name: "a", body: "12345"}, entry{name: "b", body: "123456"})
+
+		Expect(hook.extractZip(zipPath, targetDir)).To(MatchError(ContainSubstring("more than the limit of 10")))
+		expectNothingExtracted()
+	})
+})
@@ -0,0 +1,201 @@
+package dynatrace
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// maxCachedInstallers is the number of installers kept in the cache directory. Older entries get evicted after every
+// staging that used the cache.
+const maxCachedInstallers = 3
+
+// installerCache keeps downloaded OneAgent installers in the stager's cache directory, so that restaging an app doesn't
+// require downloading the same installer again.
+type installerCache struct {
+	dir string
+}
+
+// cacheEntry represents a single cached installer. The entry's directory holds the installer file and a meta.json file
+// with the validators we use for conditional requests against the deployment API. The download URL is only kept as a
+// hash, since custom OneAgent URLs may carry credentials and the cache outlives the staging.
+type cacheEntry struct {
+	dir string
+
+	Key          string    `json:"key"`
+	Version      string    `json:"version"`
+	URLHash      string    `json:"urlHash"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	LastUsed     time.Time `json:"lastUsed"`
+}
+
+// newInstallerCache returns an installerCache located in cacheDir, or nil if cacheDir is not set.
+func newInstallerCache(cacheDir string) *installerCache {
+	if cacheDir == "" {
+		return nil
+	}
+	return &installerCache{dir: filepath.Join(cacheDir, "dynatrace", "installers")}
+}
+
+// cacheKey builds the key for an installer. The download URL already contains the OS flavor, the technologies and the
+// network zone we ask for, so together with the resolved agent version it identifies the installer's content.
+func cacheKey(version, downloadURL string) string {
+	sum := sha256.Sum256([]byte(version + "\n" + downloadURL))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// urlHash identifies a download URL in the cache metadata without revealing it.
+func urlHash(downloadURL string) string {
+	sum := sha256.Sum256([]byte(downloadURL))
+	return hex.EncodeToString(sum[:])
+}
+
+// entry returns the cache entry for the given key, loading the stored metadata if it exists.
+func (c *installerCache) entry(key, version, downloadURL string) *cacheEntry {
+	e := &cacheEntry{dir: filepath.Join(c.dir, key)}
+
+	if raw, err := os.ReadFile(filepath.Join(e.dir, "meta.json")); err == nil {
+		json.Unmarshal(raw, e) // Ignore error, a broken entry is just downloaded again.
+	}
+
+	e.Key = key
+	e.Version = version
+	e.URLHash = urlHash(downloadURL)
+	return e
+}
+
+// installerPath returns the location of the cached installer file.
+func (e *cacheEntry) installerPath(installerFilename string) string {
+	return filepath.Join(e.dir, installerFilename)
+}
+
+// valid returns true if the installer file exists and we have validators to make conditional requests with.
+func (e *cacheEntry) valid(installerFilename string) bool {
+	if e.ETag == "" && e.LastModified == "" {
+		return false
+	}
+	_, err := os.Stat(e.installerPath(installerFilename))
+	return err == nil
+}
+
+// save stores the entry's metadata, marking it as the most recently used one.
+func (e *cacheEntry) save() error {
+	e.LastUsed = time.Now()
+
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(e.dir, "meta.json"), raw, 0644)
+}
+
+// entries loads the metadata of all cached installers.
+func (c *installerCache) entries() ([]*cacheEntry, error) {
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*cacheEntry
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		e := &cacheEntry{dir: filepath.Join(c.dir, d.Name())}
+		if raw, err := os.ReadFile(filepath.Join(e.dir, "meta.json")); err == nil {
+			json.Unmarshal(raw, e) // Entries with broken metadata have a zero LastUsed, so they are evicted first.
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// latest returns the most recently used entry for downloadURL, or nil if there is none.
+func (c *installerCache) latest(downloadURL string) *cacheEntry {
+	entries, err := c.entries()
+	if err != nil {
+		return nil
+	}
+
+	hash := urlHash(downloadURL)
+	var latest *cacheEntry
+	for _, e := range entries {
+		if e.URLHash == hash && (latest == nil || e.LastUsed.After(latest.LastUsed)) {
+			latest = e
+		}
+	}
+	return latest
+}
+
+// evict removes the least recently used entries so that at most maxCachedInstallers are kept.
+func (c *installerCache) evict() error {
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	if len(entries) <= maxCachedInstallers {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.After(entries[j].LastUsed) })
+
+	for _, e := range entries[maxCachedInstallers:] {
+		if err := os.RemoveAll(e.dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// downloadInstaller downloads the OneAgent installer and returns its location. If the stager provides a cache
+// directory, the installer is kept there and only downloaded again if the tenant serves a different one.
+func (h *Hook) downloadInstaller(ctx context.Context, url, installerFilename string, creds *credentials, stager Stager) (string, error) {
+	cache := newInstallerCache(stager.CacheDir())
+	if cache == nil {
+		installerFilePath := filepath.Join(os.TempDir(), installerFilename)
+		return installerFilePath, h.download(ctx, url, installerFilePath, stager, creds, nil)
+	}
+
+	version := creds.AgentVersion
+	if version == "" {
+		version = h.getLatestAgentVersion(ctx, creds, stager)
+	}
+
+	var entry *cacheEntry
+	if version == "" {
+		// Without a version, we can't tell which installer the tenant serves. We still make the request conditional
+		// on the installer we got last time from the same URL, so that it's only downloaded again if it changed.
+		entry = cache.latest(url)
+	}
+	if entry == nil {
+		entry = cache.entry(cacheKey(version, url), version, url)
+	}
+	if err := os.MkdirAll(entry.dir, 0755); err != nil {
+		return "", err
+	}
+
+	installerFilePath := entry.installerPath(installerFilename)
+	if err := h.download(ctx, url, installerFilePath, stager, creds, entry); err != nil {
+		return "", err
+	}
+
+	// Failing to maintain the cache only affects the next staging, so we just warn about it.
+	if err := entry.save(); err != nil {
+		h.Log.Warning("Failed to update installer cache: %s", err)
+	}
+	if err := cache.evict(); err != nil {
+		h.Log.Warning("Failed to evict old installers from cache: %s", err)
+	}
+
+	return installerFilePath, nil
+}
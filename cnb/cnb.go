@@ -0,0 +1,178 @@
+// Package cnb contributes the Dynatrace OneAgent to apps built with Cloud Native Buildpacks (e.g. Paketo). It shares
+// the credential discovery, download and config merge with the classic buildpack hook, only the way the agent is
+// injected differs: OneAgent becomes a launch layer, and the environment is provided through env.launch files.
+package cnb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dynatrace "github.com/Dynatrace/libbuildpack-dynatrace"
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const (
+	// agentLayer holds OneAgent at runtime.
+	agentLayer = "oneagent"
+
+	// installerLayer caches the downloaded installers between builds.
+	installerLayer = "oneagent-installers"
+)
+
+// Buildpack contributes OneAgent for apps bound to a Dynatrace service.
+type Buildpack struct {
+	Log *libbuildpack.Logger
+
+	// Hook does the installation. Its credential sources are replaced by the service bindings of the platform.
+	Hook *dynatrace.Hook
+
+	// Version is the version of the buildpack, which is added to the custom properties of the app.
+	Version string
+
+	// AppDir is the directory holding the app. If empty, it's the working directory, which the lifecycle sets to the
+	// app directory.
+	AppDir string
+}
+
+// NewBuildpack returns a Buildpack downloading the agents for the given technologies.
+func NewBuildpack(version string, technologies ...string) *Buildpack {
+	log := libbuildpack.NewLogger(os.Stdout)
+	return &Buildpack{
+		Log: log,
+		Hook: &dynatrace.Hook{
+			Log:                 log,
+			Command:             &libbuildpack.Command{},
+			IncludeTechnologies: technologies,
+			MaxDownloadRetries:  3,
+		},
+		Version: version,
+	}
+}
+
+// Detect passes if a Dynatrace service binding is available.
+func (b *Buildpack) Detect(platformDir string) (bool, error) {
+	services, err := b.bindings(platformDir).Services()
+	if err != nil {
+		return false, err
+	}
+	return len(services) > 0, nil
+}
+
+// Build installs OneAgent into a launch layer below layersDir, with the env.launch files to inject it.
+func (b *Buildpack) Build(layersDir, platformDir string) error {
+	b.Hook.CredentialSources = []dynatrace.CredentialSource{b.bindings(platformDir)}
+	b.Hook.OS = "linux"
+
+	layerDir := filepath.Join(layersDir, agentLayer)
+	if err := os.RemoveAll(layerDir); err != nil {
+		return err
+	}
+
+	cacheDir := filepath.Join(layersDir, installerLayer)
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+	if err := writeLayerMetadata(layersDir, installerLayer, layerTypes{cache: true}, ""); err != nil {
+		return err
+	}
+
+	appDir := b.AppDir
+	if appDir == "" {
+		var err error
+		if appDir, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+
+	// The hook copies the installer's environment script for classic buildpacks, which env.launch replaces. Other
+	// scripts, e.g. for metadata enrichment, are run by the launcher from the layer's profile.d directory.
+	depsDir, err := os.MkdirTemp("", "dynatrace-cnb.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(depsDir)
+
+	agent, err := b.Hook.InstallAgent(&dynatrace.DirStager{
+		App:      appDir,
+		Install:  layerDir,
+		Deps:     depsDir,
+		Profile:  filepath.Join(layerDir, "profile.d"),
+		Cache:    cacheDir,
+		Language: "cnb",
+		Version:  b.Version,
+	})
+	if err != nil {
+		return err
+	}
+
+	if agent == nil {
+		b.Log.Info("OneAgent wasn't installed, not contributing a layer.")
+		return os.RemoveAll(layerDir)
+	}
+
+	if err := writeLaunchEnv(layerDir, agent); err != nil {
+		return err
+	}
+
+	return writeLayerMetadata(layersDir, agentLayer, layerTypes{launch: true}, agent.Version)
+}
+
+// bindings returns the service bindings of the platform. SERVICE_BINDING_ROOT is set by newer platforms, older ones
+// provide them in the platform directory.
+func (b *Buildpack) bindings(platformDir string) dynatrace.ServiceBindingSource {
+	root := os.Getenv("SERVICE_BINDING_ROOT")
+	if root == "" {
+		root = filepath.Join(platformDir, "bindings")
+	}
+	return dynatrace.ServiceBindingSource{Root: root}
+}
+
+// writeLaunchEnv provides the agent's environment at launch. LD_PRELOAD is overridden, as in the classic buildpack,
+// while the DT_* variables are defaults, so that values set for the app win.
+func writeLaunchEnv(layerDir string, agent *dynatrace.Agent) error {
+	envDir := filepath.Join(layerDir, "env.launch")
+	if err := os.MkdirAll(envDir, 0755); err != nil {
+		return err
+	}
+
+	if agent.Library != "" {
+		if err := os.WriteFile(filepath.Join(envDir, "LD_PRELOAD"), []byte(agent.Library), 0644); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range agent.Env {
+		if !strings.HasPrefix(v.Name, "DT_") {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(envDir, v.Name+".default"), []byte(v.Value), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type layerTypes struct {
+	launch bool
+	build  bool
+	cache  bool
+}
+
+// writeLayerMetadata writes the <layer>.toml file describing a layer to the lifecycle. The version of the agent is kept
+// in the metadata, if known.
+func writeLayerMetadata(layersDir, layer string, types layerTypes, version string) error {
+	content := fmt.Sprintf("[types]\nlaunch = %t\nbuild = %t\ncache = %t\n", types.launch, types.build, types.cache)
+	if version != "" {
+		content += fmt.Sprintf("\n[metadata]\nversion = %s\n", tomlString(version))
+	}
+
+	return os.WriteFile(filepath.Join(layersDir, layer+".toml"), []byte(content), 0644)
+}
+
+// tomlString formats s as TOML basic string.
+func tomlString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s) + `"`
+}
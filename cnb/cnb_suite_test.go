@@ -0,0 +1,17 @@
+package cnb_test
+
+import (
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCNB(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "DynatraceCNB Suite")
+}
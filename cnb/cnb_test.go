@@ -0,0 +1,229 @@
+package cnb_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Dynatrace/libbuildpack-dynatrace/cnb"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/jarcoal/httpmock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// paasInstaller builds a self-extracting paas-sh installer holding a minimal OneAgent, with the agent library for the
+// given platform at library.
+func paasInstaller(platform, library string) string {
+	files := []struct{ name, body string }{
+		{"manifest.json", `{"version":"1.281.0.20231012-123456","technologies":{"process":{"` + platform + `":[{"path":"` + library + `","binarytype":"primary"}]}}}`},
+		{library, "library"},
+		{"agent/conf/ruxitagentproc.conf", "[general]\nkey value\n"},
+	}
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		Expect(tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), Typeflag: tar.TypeReg})).To(Succeed())
+		_, err := tw.Write([]byte(f.body))
+		Expect(err).To(BeNil())
+	}
+	Expect(tw.Close()).To(Succeed())
+	Expect(gz.Close()).To(Succeed())
+
+	return "#!/bin/sh\n" +
+		"DT_TENANT=\"abc\"\n" +
+		"DT_TENANTTOKEN=\"tenant-token\"\n" +
+		"DT_CONNECTION_POINT=\"https://a.example.com\"\n" +
+		"exit 0\n" + archive.String()
+}
+
+// muslBinary returns a minimal ELF executable requesting the musl dynamic loader.
+func muslBinary() []byte {
+	interpreter := "/lib/ld-musl-x86_64.so.1\x00"
+	headerSize, progSize := binary.Size(elf.Header64{}), binary.Size(elf.Prog64{})
+
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     uint64(headerSize),
+		Ehsize:    uint16(headerSize),
+		Phentsize: uint16(progSize),
+		Phnum:     1,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	prog := elf.Prog64{
+		Type:   uint32(elf.PT_INTERP),
+		Off:    uint64(headerSize + progSize),
+		Filesz: uint64(len(interpreter)),
+		Memsz:  uint64(len(interpreter)),
+	}
+
+	var buf bytes.Buffer
+	Expect(binary.Write(&buf, binary.LittleEndian, header)).To(Succeed())
+	Expect(binary.Write(&buf, binary.LittleEndian, prog)).To(Succeed())
+	buf.WriteString(interpreter)
+	return buf.Bytes()
+}
+
+var _ = Describe("Buildpack", func() {
+	var (
+		buildpack   *cnb.Buildpack
+		appDir      string
+		layersDir   string
+		platformDir string
+		buffer      *bytes.Buffer
+	)
+
+	writeBinding := func(name string, entries map[string]string) {
+		dir := filepath.Join(platformDir, "bindings", name)
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		for key, value := range entries {
+			Expect(os.WriteFile(filepath.Join(dir, key), []byte(value), 0644)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		appDir, err = os.MkdirTemp("", "dynatrace-cnb.app.")
+		Expect(err).To(BeNil())
+		layersDir, err = os.MkdirTemp("", "dynatrace-cnb.layers.")
+		Expect(err).To(BeNil())
+		platformDir, err = os.MkdirTemp("", "dynatrace-cnb.platform.")
+		Expect(err).To(BeNil())
+
+		os.Unsetenv("SERVICE_BINDING_ROOT")
+		os.Unsetenv("VCAP_SERVICES")
+		os.Setenv("DT_LOGSTREAM", "")
+
+		buffer = new(bytes.Buffer)
+		buildpack = cnb.NewBuildpack("1.0.0", "process")
+		buildpack.Log = libbuildpack.NewLogger(io.MultiWriter(buffer, GinkgoWriter))
+		buildpack.Hook.Log = buildpack.Log
+		buildpack.Hook.MaxDownloadRetries = 0
+		buildpack.AppDir = appDir
+
+		httpmock.Reset()
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(appDir)).To(Succeed())
+		Expect(os.RemoveAll(layersDir)).To(Succeed())
+		Expect(os.RemoveAll(platformDir)).To(Succeed())
+	})
+
+	Describe("Detect", func() {
+		It("passes with a dynatrace binding", func() {
+			writeBinding("my-dynatrace", map[string]string{"type": "dynatrace", "environmentid": "123456", "apitoken": "token"})
+
+			Expect(buildpack.Detect(platformDir)).To(BeTrue())
+		})
+
+		It("fails without a dynatrace binding", func() {
+			writeBinding("my-db", map[string]string{"type": "postgresql"})
+
+			Expect(buildpack.Detect(platformDir)).To(BeFalse())
+		})
+	})
+
+	Describe("Build", func() {
+		BeforeEach(func() {
+			writeBinding("my-dynatrace", map[string]string{
+				"type":          "dynatrace",
+				"environmentid": "123456",
+				"apitoken":      "dt0c01.ABC.DEF",
+				"apiurl":        "https://example.com/api",
+				"networkzone":   "west-us",
+			})
+
+			httpmock.RegisterResponder("GET", "https://example.com/api/v1/deployment/installer/agent/unix/paas-sh/latest?bitness=64&include=process&networkZone=west-us",
+				httpmock.NewStringResponder(200, paasInstaller("linux-x86-64", "agent/lib64/liboneagentproc.so")))
+			httpmock.RegisterResponder("GET", "https://example.com/api/v1/deployment/installer/agent/unix/paas-sh/latest/metainfo",
+				httpmock.NewStringResponder(200, `{"latestAgentVersion":"1.281.0.20231012-123456"}`))
+			httpmock.RegisterResponder("GET", "https://example.com/api/v1/deployment/installer/agent/processmoduleconfig",
+				httpmock.NewStringResponder(200, `{"properties":[{"section":"general","key":"tenant","value":"abc"}]}`))
+		})
+
+		It("contributes OneAgent as launch layer", func() {
+			Expect(buildpack.Build(layersDir, platformDir)).To(Succeed())
+
+			layerDir := filepath.Join(layersDir, "oneagent")
+
+			metadata, err := os.ReadFile(filepath.Join(layersDir, "oneagent.toml"))
+			Expect(err).To(BeNil())
+			Expect(string(metadata)).To(Equal("[types]\nlaunch = true\nbuild = false\ncache = false\n\n[metadata]\nversion = \"1.281.0.20231012-123456\"\n"))
+
+			metadata, err = os.ReadFile(filepath.Join(layersDir, "oneagent-installers.toml"))
+			Expect(err).To(BeNil())
+			Expect(string(metadata)).To(Equal("[types]\nlaunch = false\nbuild = false\ncache = true\n"))
+
+			readEnv := func(name string) string {
+				value, err := os.ReadFile(filepath.Join(layerDir, "env.launch", name))
+				Expect(err).To(BeNil())
+				return string(value)
+			}
+
+			Expect(readEnv("LD_PRELOAD")).To(Equal(filepath.Join(layerDir, "dynatrace/oneagent/agent/lib64/liboneagentproc.so")))
+			Expect(readEnv("DT_TENANT.default")).To(Equal("abc"))
+			Expect(readEnv("DT_TENANTTOKEN.default")).To(Equal("tenant-token"))
+			Expect(readEnv("DT_CONNECTION_POINT.default")).To(Equal("https://a.example.com"))
+			Expect(readEnv("DT_NETWORK_ZONE.default")).To(Equal("west-us"))
+			Expect(readEnv("DT_CUSTOM_PROP.default")).To(Equal("CloudFoundryBuildpackLanguage=cnb CloudFoundryBuildpackVersion=1.0.0"))
+
+			config, err := os.ReadFile(filepath.Join(layerDir, "dynatrace/oneagent/agent/conf/ruxitagentproc.conf"))
+			Expect(err).To(BeNil())
+			Expect(string(config)).To(ContainSubstring("tenant abc"))
+
+			_, err = os.Stat(filepath.Join(layersDir, "oneagent-installers", "dynatrace", "installers"))
+			Expect(err).To(BeNil())
+
+			_, err = os.Stat(filepath.Join(appDir, "dynatrace"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("sets up metadata enrichment from the layer", func() {
+			Expect(buildpack.Build(layersDir, platformDir)).To(Succeed())
+
+			profileDir := filepath.Join(layersDir, "oneagent", "profile.d")
+			script, err := os.ReadFile(filepath.Join(profileDir, "dynatrace-metadata.sh"))
+			Expect(err).To(BeNil())
+			Expect(string(script)).To(ContainSubstring("export DT_TAGS="))
+
+			// LD_PRELOAD is set through env.launch, the installer's script would point it to the app directory.
+			_, err = os.Stat(filepath.Join(profileDir, "dynatrace-env.sh"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("detects musl binaries in the app", func() {
+			Expect(os.WriteFile(filepath.Join(appDir, "app"), muslBinary(), 0755)).To(Succeed())
+			httpmock.RegisterResponder("GET", "https://example.com/api/v1/deployment/installer/agent/unix/paas-sh/latest?bitness=64&flavor=musl&include=process&networkZone=west-us",
+				httpmock.NewStringResponder(200, paasInstaller("linux-musl-x86-64", "agent/bin/linux-musl-x86-64/liboneagentproc.so")))
+
+			Expect(buildpack.Build(layersDir, platformDir)).To(Succeed())
+
+			preload, err := os.ReadFile(filepath.Join(layersDir, "oneagent", "env.launch", "LD_PRELOAD"))
+			Expect(err).To(BeNil())
+			Expect(string(preload)).To(Equal(filepath.Join(layersDir, "oneagent", "dynatrace/oneagent/agent/bin/linux-musl-x86-64/liboneagentproc.so")))
+		})
+
+		It("doesn't contribute a layer without binding", func() {
+			Expect(os.RemoveAll(filepath.Join(platformDir, "bindings"))).To(Succeed())
+
+			Expect(buildpack.Build(layersDir, platformDir)).To(Succeed())
+
+			_, err := os.Stat(filepath.Join(layersDir, "oneagent"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+})
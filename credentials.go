@@ -0,0 +1,130 @@
+package dynatrace
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CredentialSource is a place where the platform exposes the services bound to the app, e.g. the VCAP_SERVICES
+// environment variable on Cloud Foundry.
+type CredentialSource interface {
+	// Name identifies the source in log messages.
+	Name() string
+
+	// Services returns the Dynatrace services bound to the app.
+	Services() ([]ServiceCredentials, error)
+}
+
+// ServiceCredentials represents a bound Dynatrace service, with its credentials keyed by the configuration field names
+// (environmentid, apitoken, ...).
+type ServiceCredentials struct {
+	Name        string
+	Credentials map[string]interface{}
+}
+
+// VCAPServicesSource reads the services from the VCAP_SERVICES environment variable, matching the services having the
+// 'dynatrace' substring in their name.
+type VCAPServicesSource struct{}
+
+// Name implements CredentialSource.
+func (VCAPServicesSource) Name() string {
+	return "VCAP_SERVICES"
+}
+
+// Services implements CredentialSource.
+func (VCAPServicesSource) Services() ([]ServiceCredentials, error) {
+	// Represent the structure of the JSON object in VCAP_SERVICES for parsing.
+
+	var vcapServices map[string][]struct {
+		Name        string                 `json:"name"`
+		Credentials map[string]interface{} `json:"credentials"`
+	}
+
+	if err := json.Unmarshal([]byte(os.Getenv("VCAP_SERVICES")), &vcapServices); err != nil {
+		return nil, err
+	}
+
+	var services []ServiceCredentials
+	for _, offering := range vcapServices {
+		for _, service := range offering {
+			if strings.Contains(strings.ToLower(service.Name), "dynatrace") {
+				services = append(services, ServiceCredentials{Name: service.Name, Credentials: service.Credentials})
+			}
+		}
+	}
+
+	return services, nil
+}
+
+// ServiceBindingSource reads the services from bindings projected as files according to the servicebinding.io spec,
+// i.e. $SERVICE_BINDING_ROOT/<name>/<key>. Bindings whose type is 'dynatrace' are matched.
+type ServiceBindingSource struct {
+	// Root is the directory holding the bindings. If empty, SERVICE_BINDING_ROOT is used.
+	Root string
+}
+
+// Name implements CredentialSource.
+func (s ServiceBindingSource) Name() string {
+	return "SERVICE_BINDING_ROOT"
+}
+
+// Services implements CredentialSource.
+func (s ServiceBindingSource) Services() ([]ServiceCredentials, error) {
+	root := s.Root
+	if root == "" {
+		root = os.Getenv("SERVICE_BINDING_ROOT")
+	}
+	if root == "" {
+		return nil, nil
+	}
+
+	bindings, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []ServiceCredentials
+	for _, binding := range bindings {
+		// Kubernetes projects the files through hidden directories like '..data', which we skip.
+		if strings.HasPrefix(binding.Name(), ".") {
+			continue
+		}
+
+		bindingDir := filepath.Join(root, binding.Name())
+		if info, err := os.Stat(bindingDir); err != nil || !info.IsDir() {
+			continue
+		}
+
+		bindingType, err := os.ReadFile(filepath.Join(bindingDir, "type"))
+		if err != nil || strings.ToLower(strings.TrimSpace(string(bindingType))) != "dynatrace" {
+			continue
+		}
+
+		entries, err := os.ReadDir(bindingDir)
+		if err != nil {
+			return nil, err
+		}
+
+		creds := make(map[string]interface{})
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			value, err := os.ReadFile(filepath.Join(bindingDir, entry.Name()))
+			if err != nil {
+				continue // Directories, or entries we can't read.
+			}
+			creds[entry.Name()] = strings.TrimSpace(string(value))
+		}
+
+		services = append(services, ServiceCredentials{Name: binding.Name(), Credentials: creds})
+	}
+
+	return services, nil
+}
+
+// defaultCredentialSources are used if the hook doesn't define its own.
+var defaultCredentialSources = []CredentialSource{VCAPServicesSource{}, ServiceBindingSource{}}
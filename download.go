@@ -0,0 +1,170 @@
+package dynatrace
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// downloadProgressInterval is how often the progress of the installer download is logged.
+const downloadProgressInterval = 10 * time.Second
+
+// partialDownload keeps track of what we got from an interrupted download, so that the next attempt can continue
+// where it stopped instead of starting over.
+type partialDownload struct {
+	// offset is the number of bytes written to the file so far.
+	offset int64
+
+	// total is the size of the whole file, or -1 if unknown.
+	total int64
+
+	// validator is the ETag or Last-Modified date of the file, which makes sure we continue with the same file.
+	validator string
+
+	// etag and lastModified are kept for the installer cache.
+	etag         string
+	lastModified string
+
+	acceptRanges bool
+}
+
+// resumable returns true if the next request can ask for the rest of the file only.
+func (d *partialDownload) resumable() bool {
+	return d.offset > 0 && d.acceptRanges && d.validator != ""
+}
+
+// setRangeHeaders makes req ask for the rest of the file, if it's still the same one.
+func (d *partialDownload) setRangeHeaders(req *http.Request) {
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.offset))
+	req.Header.Set("If-Range", d.validator)
+}
+
+// start records a response holding the whole file.
+func (d *partialDownload) start(resp *http.Response) {
+	d.offset = 0
+	d.total = resp.ContentLength
+	d.etag = resp.Header.Get("ETag")
+	d.lastModified = resp.Header.Get("Last-Modified")
+	d.acceptRanges = resp.Header.Get("Accept-Ranges") == "bytes"
+
+	// Only strong ETags can be used for range requests.
+	if d.etag != "" && !strings.HasPrefix(d.etag, "W/") {
+		d.validator = d.etag
+	} else {
+		d.validator = d.lastModified
+	}
+}
+
+// resumes returns true if resp holds the rest of the file we asked for with setRangeHeaders.
+func (d *partialDownload) resumes(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+
+	first, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || first != d.offset {
+		return false
+	}
+	if total >= 0 {
+		d.total = total
+	}
+	return true
+}
+
+// parseContentRange returns the first byte and the total size from a Content-Range header like 'bytes 100-999/1000'.
+// The total is -1 if the server doesn't know it.
+func parseContentRange(value string) (first, total int64, ok bool) {
+	rest := strings.TrimPrefix(value, "bytes ")
+	if rest == value {
+		return 0, 0, false
+	}
+
+	byteRange, size, found := strings.Cut(rest, "/")
+	if !found {
+		return 0, 0, false
+	}
+	start, _, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	first, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+
+	return first, total, true
+}
+
+// downloadProgress is an io.Writer logging how much of a download was written every interval, so that slow downloads
+// can be told apart from hung ones.
+type downloadProgress struct {
+	log      *libbuildpack.Logger
+	interval time.Duration
+	now      func() time.Time
+
+	// written counts all bytes of the file, including those of previous attempts. total is -1 if unknown.
+	written int64
+	total   int64
+
+	// The throughput is measured since the start of the current attempt.
+	started      time.Time
+	startedAt    int64
+	lastReportAt time.Time
+}
+
+func newDownloadProgress(log *libbuildpack.Logger, interval time.Duration, offset, total int64) *downloadProgress {
+	p := &downloadProgress{log: log, interval: interval, now: time.Now, written: offset, total: total, startedAt: offset}
+	p.started = p.now()
+	p.lastReportAt = p.started
+	return p
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+
+	if now := p.now(); now.Sub(p.lastReportAt) >= p.interval {
+		p.lastReportAt = now
+		p.log.Info("Downloaded %s", p.describe(now))
+	}
+	return len(b), nil
+}
+
+// describe formats the progress, e.g. '12.0 MiB of 240.0 MiB (5%) at 1.2 MiB/s'.
+func (p *downloadProgress) describe(now time.Time) string {
+	s := formatBytes(p.written)
+	if p.total > 0 {
+		s += fmt.Sprintf(" of %s (%d%%)", formatBytes(p.total), p.written*100/p.total)
+	}
+
+	if elapsed := now.Sub(p.started).Seconds(); elapsed > 0 {
+		s += fmt.Sprintf(" at %s/s", formatBytes(int64(float64(p.written-p.startedAt)/elapsed)))
+	}
+	return s
+}
+
+// formatBytes formats n bytes in binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
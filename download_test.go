@@ -0,0 +1,106 @@
+package dynatrace
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("partialDownload", func() {
+	response := func(status int, headers map[string]string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}, ContentLength: 1000}
+		for k, v := range headers {
+			resp.Header.Set(k, v)
+		}
+		return resp
+	}
+
+	It("resumes with a strong ETag", func() {
+		d := &partialDownload{}
+		d.start(response(200, map[string]string{"Accept-Ranges": "bytes", "ETag": `"abc"`, "Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"}))
+		Expect(d.resumable()).To(BeFalse())
+
+		d.offset = 100
+		Expect(d.resumable()).To(BeTrue())
+
+		req, _ := http.NewRequest("GET", "https://example.com", nil)
+		d.setRangeHeaders(req)
+		Expect(req.Header.Get("Range")).To(Equal("bytes=100-"))
+		Expect(req.Header.Get("If-Range")).To(Equal(`"abc"`))
+
+		Expect(d.resumes(response(206, map[string]string{"Content-Range": "bytes 100-999/1000"}))).To(BeTrue())
+		Expect(d.resumes(response(206, map[string]string{"Content-Range": "bytes 0-999/1000"}))).To(BeFalse())
+		Expect(d.resumes(response(200, nil))).To(BeFalse())
+	})
+
+	It("falls back to Last-Modified for weak ETags", func() {
+		d := &partialDownload{}
+		d.start(response(200, map[string]string{"Accept-Ranges": "bytes", "ETag": `W/"abc"`, "Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"}))
+		Expect(d.validator).To(Equal("Mon, 02 Jan 2006 15:04:05 GMT"))
+	})
+
+	It("doesn't resume without range support or validator", func() {
+		d := &partialDownload{}
+		d.start(response(200, map[string]string{"ETag": `"abc"`}))
+		d.offset = 100
+		Expect(d.resumable()).To(BeFalse())
+
+		d.start(response(200, map[string]string{"Accept-Ranges": "bytes"}))
+		d.offset = 100
+		Expect(d.resumable()).To(BeFalse())
+	})
+})
+
+var _ = Describe("parseContentRange", func() {
+	It("parses the first byte and total size", func() {
+		first, total, ok := parseContentRange("bytes 100-999/1000")
+		Expect(ok).To(BeTrue())
+		Expect(first).To(Equal(int64(100)))
+		Expect(total).To(Equal(int64(1000)))
+
+		first, total, ok = parseContentRange("bytes 100-999/*")
+		Expect(ok).To(BeTrue())
+		Expect(first).To(Equal(int64(100)))
+		Expect(total).To(Equal(int64(-1)))
+	})
+
+	It("rejects invalid values", func() {
+		for _, value := range []string{"", "items 0-1/2", "bytes */1000", "bytes 100-999", "bytes 100-999/x"} {
+			_, _, ok := parseContentRange(value)
+			Expect(ok).To(BeFalse(), value)
+		}
+	})
+})
+
+var _ = Describe("downloadProgress", func() {
+	It("logs the progress every interval", func() {
+		buffer := new(bytes.Buffer)
+		now := time.Now()
+
+		p := newDownloadProgress(libbuildpack.NewLogger(buffer), 10*time.Second, 1<<20, 4<<20)
+		p.started = now
+		p.lastReportAt = now
+		p.now = func() time.Time { return now }
+
+		now = now.Add(5 * time.Second)
+		p.Write(make([]byte, 1<<20))
+		Expect(buffer.String()).To(BeEmpty())
+
+		now = now.Add(5 * time.Second)
+		p.Write(make([]byte, 1<<20))
+		Expect(buffer.String()).To(ContainSubstring("Downloaded 3.0 MiB of 4.0 MiB (75%) at 204.8 KiB/s"))
+	})
+})
+
+var _ = Describe("formatBytes", func() {
+	It("uses binary units", func() {
+		Expect(formatBytes(512)).To(Equal("512 B"))
+		Expect(formatBytes(1536)).To(Equal("1.5 KiB"))
+		Expect(formatBytes(240 << 20)).To(Equal("240.0 MiB"))
+		Expect(formatBytes(3 << 30)).To(Equal("3.0 GiB"))
+	})
+})
@@ -0,0 +1,151 @@
+package dynatrace
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// metadataDir is where the metadata enrichment files are written to at container start, relative to the app dir.
+const metadataDir = "dynatrace/enrichment"
+
+// metadataEntry is a Cloud Foundry attribute for metadata enrichment. Entries either have a value known at staging
+// time, or the name of the environment variable holding it at runtime.
+type metadataEntry struct {
+	key        string
+	value      string
+	runtimeVar string
+}
+
+var unsafeTagCharacters = regexp.MustCompile(`\s+`)
+
+// getMetadata returns the Cloud Foundry topology of the app. Org, space and app are taken from VCAP_APPLICATION during
+// staging, while the instance is only known when the container starts.
+func (h *Hook) getMetadata() []metadataEntry {
+	app := h.getVCAPApplication()
+
+	all := []metadataEntry{
+		{key: "cloudfoundry.org.id", value: app.OrganizationID},
+		{key: "cloudfoundry.org.name", value: app.OrganizationName},
+		{key: "cloudfoundry.space.id", value: app.SpaceID},
+		{key: "cloudfoundry.space.name", value: app.SpaceName},
+		{key: "cloudfoundry.app.id", value: app.ApplicationID},
+		{key: "cloudfoundry.app.name", value: app.ApplicationName},
+		{key: "cloudfoundry.app.instance.id", runtimeVar: "CF_INSTANCE_GUID"},
+		{key: "cloudfoundry.app.instance.index", runtimeVar: "CF_INSTANCE_INDEX"},
+	}
+
+	var entries []metadataEntry
+	for _, e := range all {
+		if e.value != "" || e.runtimeVar != "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// setUpMetadataEnrichment writes a profile.d script which creates the dt_metadata.json and dt_metadata.properties
+// enrichment files when the container starts, and adds the metadata to DT_TAGS and DT_CUSTOM_PROP.
+func (h *Hook) setUpMetadataEnrichment(stager Stager, report *stagingReport) error {
+	entries := h.getMetadata()
+
+	var filename, script string
+	if h.getOS() == osWindows {
+		filename, script = "dynatrace-metadata.cmd", metadataScriptWindows(entries)
+	} else {
+		filename, script = "dynatrace-metadata.sh", metadataScriptUnix(entries)
+	}
+
+	h.Log.Debug("Writing %s for metadata enrichment...", filename)
+	if err := stager.WriteProfileD(filename, script); err != nil {
+		return err
+	}
+
+	pairs := strings.Join(metadataPairs(entries, func(s string) string { return s }, runtimeReference), " ")
+	report.addEnv("DT_TAGS", pairs)
+	report.addEnv("DT_CUSTOM_PROP", pairs)
+
+	return nil
+}
+
+// runtimeReference references an environment variable in a shell script.
+func runtimeReference(name string) string {
+	return "${" + name + "}"
+}
+
+// metadataPairs formats the entries as 'key=value' pairs for DT_TAGS and DT_CUSTOM_PROP. The pairs are separated by
+// spaces, so spaces in values are replaced. Static values are passed through escape, runtime ones through ref.
+func metadataPairs(entries []metadataEntry, escape, ref func(string) string) []string {
+	var pairs []string
+	for _, e := range entries {
+		value := escape(unsafeTagCharacters.ReplaceAllString(e.value, "_"))
+		if e.runtimeVar != "" {
+			value = ref(e.runtimeVar)
+		}
+		pairs = append(pairs, e.key+"="+value)
+	}
+	return pairs
+}
+
+// jsonString encodes s as JSON string without the surrounding quotes.
+func jsonString(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded[1 : len(encoded)-1])
+}
+
+func metadataScriptUnix(entries []metadataEntry) string {
+	// The files are written from unquoted here-documents, so that runtime variables are expanded, but nothing else.
+	heredocEscape := strings.NewReplacer(`\`, `\\`, "$", `\$`, "`", "\\`").Replace
+
+	var jsonLines, properties []string
+	for _, e := range entries {
+		jsonValue, value := heredocEscape(jsonString(e.value)), heredocEscape(e.value)
+		if e.runtimeVar != "" {
+			jsonValue, value = runtimeReference(e.runtimeVar), runtimeReference(e.runtimeVar)
+		}
+		jsonLines = append(jsonLines, fmt.Sprintf("  \"%s\": \"%s\"", e.key, jsonValue))
+		properties = append(properties, e.key+"="+value)
+	}
+
+	pairs := strings.Join(metadataPairs(entries, shellQuote, runtimeReference), " ")
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("mkdir -p \"${HOME}/%s\"\n", metadataDir))
+	sb.WriteString(fmt.Sprintf("cat > \"${HOME}/%s/dt_metadata.json\" <<EOF\n{\n%s\n}\nEOF\n", metadataDir, strings.Join(jsonLines, ",\n")))
+	sb.WriteString(fmt.Sprintf("cat > \"${HOME}/%s/dt_metadata.properties\" <<EOF\n%s\nEOF\n", metadataDir, strings.Join(properties, "\n")))
+	sb.WriteString(fmt.Sprintf("export DT_TAGS=\"${DT_TAGS} %s\"\n", pairs))
+	sb.WriteString(fmt.Sprintf("export DT_CUSTOM_PROP=\"${DT_CUSTOM_PROP} %s\"\n", pairs))
+	return sb.String()
+}
+
+func metadataScriptWindows(entries []metadataEntry) string {
+	// The JSON values are echoed inside double quotes, everything else unquoted.
+	unquoted := func(s string) string { return cmdEscape(s, false) }
+	cmdReference := func(name string) string { return "%" + name + "%" }
+
+	dir := `C:\users\vcap\app\` + strings.ReplaceAll(metadataDir, "/", `\`)
+
+	var jsonLines, properties []string
+	for _, e := range entries {
+		jsonValue, value := cmdEscape(jsonString(e.value), true), unquoted(e.value)
+		if e.runtimeVar != "" {
+			jsonValue, value = cmdReference(e.runtimeVar), cmdReference(e.runtimeVar)
+		}
+		jsonLines = append(jsonLines, fmt.Sprintf(`echo   "%s": "%s"`, e.key, jsonValue))
+		properties = append(properties, fmt.Sprintf("echo %s=%s", e.key, value))
+	}
+	for i := 0; i < len(jsonLines)-1; i++ {
+		jsonLines[i] += ","
+	}
+
+	pairs := strings.Join(metadataPairs(entries, unquoted, cmdReference), " ")
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("if not exist \"%s\" mkdir \"%s\"\n", dir, dir))
+	sb.WriteString(fmt.Sprintf("> \"%s\\dt_metadata.json\" (\necho {\n%s\necho }\n)\n", dir, strings.Join(jsonLines, "\n")))
+	sb.WriteString(fmt.Sprintf("> \"%s\\dt_metadata.properties\" (\n%s\n)\n", dir, strings.Join(properties, "\n")))
+	sb.WriteString(fmt.Sprintf("set DT_TAGS=%%DT_TAGS%% %s\n", pairs))
+	sb.WriteString(fmt.Sprintf("set DT_CUSTOM_PROP=%%DT_CUSTOM_PROP%% %s\n", pairs))
+	return sb.String()
+}
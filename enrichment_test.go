@@ -0,0 +1,76 @@
+package dynatrace
+
+import (
+	"encoding/json"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// cmdEcho returns what cmd prints for an echo command from a .cmd script: doubled percent signs are printed once, and
+// carets outside of double quotes escape the next character.
+func cmdEcho(command string) string {
+	line := strings.TrimPrefix(command, "echo ")
+
+	var sb strings.Builder
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '%' && i+1 < len(line) && line[i+1] == '%':
+			sb.WriteByte('%')
+			i++
+		case c == '"':
+			quoted = !quoted
+			sb.WriteByte(c)
+		case c == '^' && !quoted && i+1 < len(line):
+			i++
+			sb.WriteByte(line[i])
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+var _ = Describe("metadataScriptWindows", func() {
+	const name = `Jim "Bob" & (100%) <a|b> ^`
+
+	var lines []string
+
+	BeforeEach(func() {
+		script := metadataScriptWindows([]metadataEntry{
+			{key: "cloudfoundry.app.name", value: name},
+			{key: "cloudfoundry.app.instance.id", runtimeVar: "CF_INSTANCE_GUID"},
+		})
+		lines = strings.Split(script, "\n")
+	})
+
+	It("writes the values to dt_metadata.json as they are", func() {
+		var doc strings.Builder
+		inJSON := false
+		for _, line := range lines {
+			switch {
+			case line == "echo {":
+				inJSON = true
+				doc.WriteString("{\n")
+			case line == "echo }":
+				inJSON = false
+				doc.WriteString("}\n")
+			case inJSON:
+				doc.WriteString(cmdEcho(line) + "\n")
+			}
+		}
+
+		var metadata map[string]string
+		Expect(json.Unmarshal([]byte(strings.ReplaceAll(doc.String(), "%CF_INSTANCE_GUID%", "guid")), &metadata)).To(Succeed())
+		Expect(metadata).To(Equal(map[string]string{
+			"cloudfoundry.app.name":        name,
+			"cloudfoundry.app.instance.id": "guid",
+		}))
+	})
+
+	It("writes the values to dt_metadata.properties as they are", func() {
+		Expect(lines).To(ContainElement(WithTransform(cmdEcho, Equal("cloudfoundry.app.name="+name))))
+	})
+})
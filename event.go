@@ -0,0 +1,103 @@
+package dynatrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// deploymentEvent represents the payload for the Events API v2.
+type deploymentEvent struct {
+	EventType      string            `json:"eventType"`
+	Title          string            `json:"title"`
+	EntitySelector string            `json:"entitySelector,omitempty"`
+	Properties     map[string]string `json:"properties"`
+}
+
+// sendDeploymentEvent posts a CUSTOM_DEPLOYMENT event for the staged app to the tenant, once Dynatrace was set up in
+// either mode. Failing to send the event only results in a warning, it must never break staging.
+func (h *Hook) sendDeploymentEvent(ctx context.Context, creds *credentials, stager Stager, agentVersion string) {
+	// With only a customoneagenturl, we don't know the tenant to send the event to.
+	if creds.APIToken == "" || (creds.APIURL == "" && creds.EnvironmentID == "") {
+		h.Log.Warning("Not sending deployment event, it requires apitoken and environmentid or apiurl")
+		return
+	}
+
+	apiURL, err := h.ensureApiURL(creds)
+	if err != nil {
+		h.Log.Warning("Failed to send deployment event: %s", err)
+		return
+	}
+
+	app := h.getVCAPApplication()
+
+	ver, err := stager.BuildpackVersion()
+	if err != nil {
+		ver = "unknown"
+	}
+
+	event := deploymentEvent{
+		EventType:      "CUSTOM_DEPLOYMENT",
+		Title:          fmt.Sprintf("Staged %s", app.ApplicationName),
+		EntitySelector: creds.EventSelector,
+		Properties: map[string]string{
+			"dt.event.deployment.name":      app.ApplicationName,
+			"dt.event.deployment.version":   app.ApplicationVersion,
+			"CloudFoundryAppName":           app.ApplicationName,
+			"CloudFoundryAppID":             app.ApplicationID,
+			"CloudFoundrySpaceName":         app.SpaceName,
+			"CloudFoundryOrgName":           app.OrganizationName,
+			"CloudFoundryBuildpackLanguage": stager.BuildpackLanguage(),
+			"CloudFoundryBuildpackVersion":  ver,
+			"OneAgentVersion":               agentVersion,
+		},
+	}
+
+	// Empty properties are of no use on the event.
+	for key, value := range event.Properties {
+		if value == "" {
+			delete(event.Properties, key)
+		}
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		h.Log.Warning("Failed to send deployment event: %s", err)
+		return
+	}
+
+	eventURL := apiURL + "/v2/events/ingest"
+	h.Log.Debug("Sending deployment event to %s", eventURL)
+
+	client := h.newHTTPClient(creds, 5*time.Second)
+	// The event is sent only once: it's not essential to the staging, and sending it again after a timeout may
+	// ingest it twice.
+	err = func() error {
+		req, err := h.newAPIRequest(ctx, "POST", eventURL, bytes.NewReader(body), stager, creds)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if err := checkResponse(resp); err != nil {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil
+	}()
+	if err != nil {
+		h.Log.Warning("Failed to send deployment event, %s", err)
+		return
+	}
+
+	h.Log.Info("Sent deployment event to Dynatrace.")
+}
@@ -0,0 +1,124 @@
+package dynatrace
+
+import (
+	"debug/elf"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	flavorDefault     = "default"
+	flavorMusl        = "musl"
+	flavorMultidistro = "multidistro"
+)
+
+// maxFlavorDetectionFiles limits the number of files we look at when detecting the libc used by the app, so that huge
+// build directories don't slow down staging.
+const maxFlavorDetectionFiles = 5000
+
+// errDetectionDone is used to stop walking the build directory once the libc has been detected.
+var errDetectionDone = errors.New("detection done")
+
+// getFlavor returns the flavor of the code modules to download. The flavor configured in the credentials wins,
+// otherwise the musl flavor is chosen for apps whose binaries link against musl libc.
+func (h *Hook) getFlavor(creds *credentials, buildDir string) (string, error) {
+	switch creds.Flavor {
+	case flavorDefault, flavorMusl, flavorMultidistro:
+		return creds.Flavor, nil
+	case "":
+	default:
+		return "", errors.New("unsupported flavor: " + creds.Flavor)
+	}
+
+	if detectMusl(buildDir) {
+		h.Log.Debug("Detected binaries linked against musl libc, using flavor %s", flavorMusl)
+		return flavorMusl, nil
+	}
+	return flavorDefault, nil
+}
+
+// usesMusl returns true if the code modules for musl libc have to be injected.
+func (h *Hook) usesMusl(creds *credentials, buildDir string) bool {
+	switch creds.Flavor {
+	case flavorMusl:
+		return true
+	case flavorMultidistro:
+		// Multidistro packages contain the code modules for both, so we pick the ones matching the app.
+		return detectMusl(buildDir)
+	}
+	return false
+}
+
+// detectMusl looks for ELF binaries in dir and returns true if the first dynamically linked one found uses the musl
+// dynamic loader as interpreter.
+func detectMusl(dir string) bool {
+	musl := false
+	files := 0
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Ignore unreadable entries.
+		}
+		if d.IsDir() {
+			// Skip the OneAgent itself, it may be installed already.
+			if path == filepath.Join(dir, "dynatrace") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if files++; files > maxFlavorDetectionFiles {
+			return errDetectionDone
+		}
+
+		interpreter := readELFInterpreter(path)
+		if interpreter == "" {
+			return nil
+		}
+
+		musl = strings.Contains(interpreter, "ld-musl")
+		return errDetectionDone
+	})
+
+	return musl
+}
+
+// readELFInterpreter returns the interpreter requested by an ELF executable, or an empty string if the file is not a
+// dynamically linked ELF executable.
+func readELFInterpreter(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := f.ReadAt(magic, 0); err != nil || string(magic) != elf.ELFMAG {
+		return ""
+	}
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return ""
+	}
+
+	for _, prog := range ef.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+
+		interpreter := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(interpreter, 0); err != nil {
+			return ""
+		}
+		return strings.TrimRight(string(interpreter), "\x00")
+	}
+
+	return ""
+}
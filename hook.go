@@ -1,18 +1,16 @@
 package dynatrace
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
-	"runtime"
 	"strings"
 	"time"
 
@@ -28,6 +26,7 @@ type Command interface {
 // credentials represent the user settings extracted from the environment.
 type credentials struct {
 	ServiceName       string
+	Source            string
 	EnvironmentID     string
 	CustomOneAgentURL string
 	APIToken          string
@@ -36,6 +35,47 @@ type credentials struct {
 	NetworkZone       string
 	EnableFIPS        bool
 	AddTechnologies   string
+	AgentVersion      string
+	Flavor            string
+
+	InstallerChecksum         string
+	InstallerCertificate      string
+	SkipSignatureVerification bool
+
+	DeploymentEvent bool
+	EventSelector   string
+
+	Mode string
+
+	ReleaseProduct      string
+	ReleaseVersion      string
+	ReleaseStage        string
+	ReleaseBuildVersion string
+
+	// CACert, ClientCert and ClientKey hold PEM, inline or base64-encoded, for the TLS connections to the tenant.
+	CACert       string
+	ClientCert   string
+	ClientKey    string
+	InjectCACert bool
+
+	// Timeout limits how long setting up Dynatrace may take, see getTimeout.
+	Timeout string
+
+	// AgentConfig holds the raw agentconfig setting, see parseAgentConfigOverrides.
+	AgentConfig interface{}
+
+	// Proxy is used for all requests against the tenant and by OneAgent at runtime, DownloadProxy for downloading the
+	// installer, if set.
+	Proxy         string
+	DownloadProxy string
+
+	// tlsConfig and the proxy URLs are set up by setUpTLS and setUpProxy, the transports are created from them when
+	// needed, see newHTTPClient.
+	tlsConfig         *tls.Config
+	proxyURL          *url.URL
+	downloadProxyURL  *url.URL
+	transport         http.RoundTripper
+	downloadTransport http.RoundTripper
 }
 
 // Hook implements libbuildpack.Hook. It downloads and install the Dynatrace OneAgent.
@@ -47,8 +87,47 @@ type Hook struct {
 	// IncludeTechnologies is used to indicate the technologies we want to download agents for.
 	IncludeTechnologies []string
 
-	// MaxDownloadRetries is the maximum number of retries the hook will try to download the agent if they fail.
+	// MaxDownloadRetries is the maximum number of retries for failed requests against the tenant or the OneAgent mirror,
+	// e.g. to download the agent. Errors which retrying can't resolve, like a 404 or an invalid API token, fail fast.
 	MaxDownloadRetries int
+
+	// MaxRetryDuration limits the total time spent on a request including its retries. RetryBaseDelay is the delay
+	// before the first retry, which is doubled for every further one. Retry-After headers sent by the tenant are
+	// honored instead. If zero, defaultMaxRetryDuration and defaultRetryBaseDelay apply.
+	MaxRetryDuration time.Duration
+	RetryBaseDelay   time.Duration
+
+	// CredentialSources are queried for bound Dynatrace services. If empty, the services are read from VCAP_SERVICES
+	// and from servicebinding.io bindings below SERVICE_BINDING_ROOT.
+	CredentialSources []CredentialSource
+
+	// InstallerCertificates holds the PEM-encoded root certificates trusted to sign paas-sh installers. It can be
+	// overridden through the installercert credential. If there are none, the signature isn't verified.
+	InstallerCertificates []byte
+
+	// SkipSignatureVerification runs paas-sh installers without verifying their signature against
+	// InstallerCertificates. A root certificate set through the installercert credential is verified against anyway.
+	SkipSignatureVerification bool
+
+	// MaxExtractedSize and MaxExtractedFiles limit the total size and the number of files extracted from the installer
+	// archive. Archives exceeding them are rejected. If zero, defaultMaxExtractedSize and defaultMaxExtractedFiles apply.
+	MaxExtractedSize  int64
+	MaxExtractedFiles int
+
+	// OS is the operating system of the platform the app runs on, "linux" or "windows". If empty, it's derived from
+	// CF_STACK, falling back to the operating system the hook runs on.
+	OS string
+
+	// Arch is the CPU architecture of the platform the app runs on, "x86" or "arm". If empty, it's derived from
+	// CF_STACK, falling back to the architecture the hook runs on.
+	Arch string
+
+	// Timeout limits how long setting up Dynatrace may take, unless set through the timeout credential or the
+	// DT_STAGING_TIMEOUT environment variable. Zero means no limit.
+	Timeout time.Duration
+
+	// prefetched is the background download started by BeforeCompile, if any.
+	prefetched *prefetch
 }
 
 // NewHook returns a libbuildpack.Hook instance for integrating monitoring with Dynatrace. The technology names for the
@@ -64,102 +143,309 @@ func NewHook(technologies ...string) libbuildpack.Hook {
 
 // AfterCompile downloads and installs the Dynatrace agent.
 func (h *Hook) AfterCompile(stager *libbuildpack.Stager) error {
+	return h.Install(stager)
+}
+
+// Install downloads and installs the Dynatrace agent for the app staged by stager.
+func (h *Hook) Install(stager Stager) error {
+	return h.InstallContext(context.Background(), stager)
+}
+
+// InstallContext is like Install, but stops downloading and installing the agent when ctx is done.
+func (h *Hook) InstallContext(ctx context.Context, stager Stager) error {
+	_, err := h.install(ctx, stager)
+	return err
+}
+
+// InstallAgent installs the Dynatrace agent like Install, and describes the installed agent for integrations which set
+// up the injection themselves. It returns nil if no agent was installed, e.g. because there are no credentials.
+func (h *Hook) InstallAgent(stager Stager) (*Agent, error) {
+	report, err := h.install(context.Background(), stager)
+	if err != nil || report == nil || report.InstallationState != "installed" {
+		return nil, err
+	}
+	return newAgent(stager, report)
+}
+
+// install does the work of Install, returning the staging report if the credentials were found.
+func (h *Hook) install(ctx context.Context, stager Stager) (*stagingReport, error) {
 	// All other methods in this package are called  from here, which
 	// makes it the main entry-point.
 
 	var err error
 
+	// Everything we log from here on goes through the redactor, so that secrets never reach the staging logs.
+	logRedactor := h.redactLog()
+	defer logRedactor.Flush()
+
+	// The download started by BeforeCompile must not outlive the installation, however it ends.
+	defer h.stopPrefetch()
+
 	h.Log.Debug("Checking for enabled dynatrace service...")
 
 	// Get credentials...
 	creds := h.getCredentials()
 	if creds == nil {
 		h.Log.Debug("Dynatrace service credentials not found!")
-		return nil
+		return nil, nil
 	}
+	logRedactor.addSecrets(creds.secrets()...)
 
 	h.Log.Info("Dynatrace service credentials found. Setting up Dynatrace OneAgent.")
 
 	installDir := filepath.Join("dynatrace", "oneagent")
 
+	// The report is written whatever the outcome, so that it's clear from the droplet what happened.
+	report := newStagingReport(creds, h.IncludeTechnologies)
+	defer h.writeStagingReport(report, filepath.Join(installRoot(stager), installDir))
+
+	timeout, mode, step, err := h.setUp(creds)
+	if err != nil && creds.SkipErrors {
+		h.Log.Warning("Error during %s, skipping installation: %s", step, err)
+		report.skip(strings.ToLower(step), err)
+		report.InstallationState = "skipped"
+		return report, nil
+	} else if err != nil {
+		h.Log.Error("Error during %s: %s", step, err)
+		return report, err
+	}
+	if timeout > 0 {
+		h.Log.Debug("Setting up Dynatrace has to finish within %v", timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Wait for the download started by BeforeCompile, its results are used below where they still apply.
+	prefetched := h.joinPrefetch(ctx)
+
+	if mode == modeOTel {
+		done := report.startPhase("otel")
+		err := h.setUpOTelExport(creds, stager, report)
+		done()
+		if err != nil && creds.SkipErrors {
+			h.Log.Warning("Error during OpenTelemetry export setup, skipping it: %s", err)
+			report.skip("otel setup", err)
+			report.InstallationState = "skipped"
+			return report, nil
+		} else if err != nil {
+			h.Log.Error("Error during OpenTelemetry export setup: %s", err)
+			return report, err
+		}
+
+		report.InstallationState = "otel"
+		h.Log.Info("Dynatrace OpenTelemetry export is set up.")
+
+		if creds.DeploymentEvent {
+			h.sendDeploymentEvent(ctx, creds, stager, "")
+		}
+		return report, nil
+	}
+
 	// download installer
 	var installerFilename string
-	if runtime.GOOS == "linux" {
+	if h.getOS() == osLinux {
 		installerFilename = "paasInstaller.sh"
-	} else if runtime.GOOS == "windows" {
+	} else if h.getOS() == osWindows {
 		installerFilename = "paasInstaller.zip"
 	} else {
 		// This is the only place where we need to return an error.
 		// All following operating system checks are just to determine installation specifics.
-		return errors.New("libbuildpack-dynatrace: Unsupported operating system: " + runtime.GOOS)
+		return report, errors.New("libbuildpack-dynatrace: Unsupported operating system: " + h.getOS())
+	}
+
+	if creds.AgentVersion != "" && creds.CustomOneAgentURL != "" {
+		h.Log.Warning("agentversion is ignored since customoneagenturl is configured")
+		creds.AgentVersion = ""
+	} else if creds.AgentVersion != "" {
+		done := report.startPhase("resolve-version")
+		var version string
+		var err error
+		if version = prefetched.resolvedVersion(creds.AgentVersion); version == "" {
+			version, err = h.resolveAgentVersion(ctx, creds, stager)
+		}
+		done()
+		if err != nil && creds.SkipErrors {
+			h.Log.Warning("Error during OneAgent version resolution, skipping installation: %s", err)
+			report.skip("version resolution", err)
+			report.InstallationState = "skipped"
+			return report, nil
+		} else if err != nil {
+			h.Log.Error("Error during OneAgent version resolution: %s", err)
+			return report, err
+		}
+		h.Log.Info("Using OneAgent version %s", version)
+		creds.AgentVersion = version
+	}
+
+	if h.getOS() == osLinux && creds.CustomOneAgentURL == "" {
+		flavor, err := h.getFlavor(creds, stager.BuildDir())
+		if err != nil && creds.SkipErrors {
+			h.Log.Warning("Error during OneAgent flavor selection, skipping installation: %s", err)
+			report.skip("flavor selection", err)
+			report.InstallationState = "skipped"
+			return report, nil
+		} else if err != nil {
+			h.Log.Error("Error during OneAgent flavor selection: %s", err)
+			return report, err
+		}
+		creds.Flavor = flavor
 	}
 
-	installerFilePath := filepath.Join(os.TempDir(), installerFilename)
-	url := h.getDownloadURL(creds)
-	err = h.download(url, installerFilePath, stager, creds)
+	downloadURL := h.getDownloadURL(creds)
+	report.DownloadURL = redactURL(downloadURL)
+
+	done := report.startPhase("download")
+	installerFilePath, ok, err := prefetched.installer(downloadURL)
+	if ok {
+		h.Log.Debug("Using OneAgent installer downloaded during compilation")
+	} else {
+		installerFilePath, err = h.downloadInstaller(ctx, downloadURL, installerFilename, creds, stager)
+	}
+	done()
 	if err != nil && creds.SkipErrors {
 		h.Log.Warning("Error during installer download, skipping installation")
-		return nil
-	}else if err != nil {
-		return err
+		report.skip("installer download", err)
+		report.InstallationState = "skipped"
+		return report, nil
+	} else if err != nil {
+		return report, err
+	}
+
+	// verify installer
+	done = report.startPhase("verify")
+	err = h.verifyInstaller(installerFilePath, creds)
+	done()
+	if err != nil {
+		// The installer may have been tampered with, so we never run it, but still honor skiperrors.
+		os.Remove(installerFilePath)
+		if creds.SkipErrors {
+			h.Log.Warning("Error during installer verification, skipping installation: %s", err)
+			report.skip("installer verification", err)
+			report.InstallationState = "skipped"
+			return report, nil
+		}
+		h.Log.Error("Error during installer verification: %s", err)
+		return report, err
 	}
 
 	// run installer
-	if runtime.GOOS == "linux" {
-		err = h.runInstallerUnix(installerFilePath, installDir, creds, stager)
-	} else if runtime.GOOS == "windows" {
-		err = h.runInstallerWindows(installerFilePath, installDir, creds, stager)
+	done = report.startPhase("install")
+	if h.getOS() == osLinux {
+		err = h.runInstallerUnix(ctx, installerFilePath, installDir, creds, stager, report)
+	} else if h.getOS() == osWindows {
+		err = h.runInstallerWindows(installerFilePath, installDir, creds, stager, report)
+	}
+	done()
+	if err != nil && creds.SkipErrors {
+		h.Log.Warning("Error during installation, skipping it: %s", err)
+		report.skip("installation", err)
+		report.InstallationState = "skipped"
+		return report, nil
+	} else if err != nil {
+		h.Log.Error("Error during installation: %s", err)
+		return report, err
+	}
+
+	// set up metadata enrichment
+	if err := h.setUpMetadataEnrichment(stager, report); err != nil {
+		h.Log.Error("Error during metadata enrichment setup: %s", err)
+		return report, err
+	}
+
+	configDir := filepath.Join(installRoot(stager), installDir)
+
+	// let the agent trust the same CA at runtime
+	if creds.InjectCACert && creds.CACert != "" {
+		if err := h.installCACert(creds, configDir); err != nil {
+			h.Log.Error("Error during cacert installation: %s", err)
+			return report, err
+		}
 	}
 
 	// update agent config
 	h.Log.Debug("Fetching updated OneAgent configuration from tenant... ")
-	configDir := filepath.Join(stager.BuildDir(), installDir)
-	if err := h.updateAgentConfig(creds, configDir, stager); err != nil {
+	done = report.startPhase("config")
+	err = h.updateAgentConfig(ctx, creds, configDir, stager, report, prefetched)
+	done()
+	if err != nil {
 		if creds.SkipErrors {
 			h.Log.Warning("Error during agent config update, skipping it")
-			return nil
+			report.skip("agent config update", err)
+			report.InstallationState = "installed"
+
+			if creds.DeploymentEvent {
+				report.AgentVersion = readManifestVersion(configDir)
+				h.sendDeploymentEvent(ctx, creds, stager, report.AgentVersion)
+			}
+			return report, nil
 		}
 		h.Log.Error("Error during agent config update: %s", err)
-		return err
+		return report, err
 
 	}
 
 	if h.getCredentials().EnableFIPS {
 		h.Log.Debug("Removing file 'dt_fips_disabled.flag' to enable FIPS mode...")
-		flagFilePath := filepath.Join(stager.BuildDir(), installDir, "agent", "dt_fips_disabled.flag")
+		flagFilePath := filepath.Join(installRoot(stager), installDir, "agent", "dt_fips_disabled.flag")
 		if err := os.Remove(flagFilePath); err != nil {
 			h.Log.Error("Error during fips flag file deletion: %s", err)
-			return err
+			return report, err
 		}
+		report.FIPSEnabled = true
 	}
 
+	report.InstallationState = "installed"
 	h.Log.Info("Dynatrace OneAgent injection is set up.")
-	return nil
+
+	if creds.DeploymentEvent {
+		report.AgentVersion = readManifestVersion(configDir)
+		h.sendDeploymentEvent(ctx, creds, stager, report.AgentVersion)
+	}
+
+	return report, nil
 }
 
-// getCredentials returns the configuration from the environment, or nil if not found. The credentials are represented
-// as a JSON object in the VCAP_SERVICES environment variable.
-func (h *Hook) getCredentials() *credentials {
-	// Represent the structure of the JSON object in VCAP_SERVICES for parsing.
+// setUp applies the settings from the credentials which all requests against the tenant depend on, and selects the
+// mode. It's shared by install and the download started by BeforeCompile. On failure, step names what failed.
+func (h *Hook) setUp(creds *credentials) (timeout time.Duration, mode, step string, err error) {
+	if timeout, err = h.getTimeout(creds); err != nil {
+		return 0, "", "timeout setup", err
+	}
 
-	var vcapServices map[string][]struct {
-		Name        string                 `json:"name"`
-		Credentials map[string]interface{} `json:"credentials"`
+	// The TLS and proxy settings apply to all requests against the tenant, in every mode.
+	if err = h.setUpTLS(creds); err != nil {
+		return 0, "", "TLS setup", err
+	}
+	if err = h.setUpProxy(creds); err != nil {
+		return 0, "", "proxy setup", err
 	}
 
-	if err := json.Unmarshal([]byte(os.Getenv("VCAP_SERVICES")), &vcapServices); err != nil {
-		h.Log.Debug("Failed to unmarshal VCAP_SERVICES: %s", err)
-		return nil
+	if mode, err = getMode(creds); err != nil {
+		return 0, "", "mode selection", err
+	}
+	return timeout, mode, "", nil
+}
+
+// getCredentials returns the configuration from the environment, or nil if not found. The credentials are read from
+// the hook's credential sources, by default the VCAP_SERVICES environment variable and servicebinding.io bindings. The
+// first source holding a matching service is used, as some platforms expose the same binding through several sources.
+func (h *Hook) getCredentials() *credentials {
+	sources := h.CredentialSources
+	if len(sources) == 0 {
+		sources = defaultCredentialSources
 	}
 
 	var found []*credentials
 
-	for _, services := range vcapServices {
-		for _, service := range services {
-			if !strings.Contains(strings.ToLower(service.Name), "dynatrace") {
-				continue
-			}
+	for _, source := range sources {
+		services, err := source.Services()
+		if err != nil {
+			h.Log.Debug("Failed to read services from %s: %s", source.Name(), err)
+			continue
+		}
 
+		for _, service := range services {
 			queryString := func(key string) string {
 				if value, ok := service.Credentials[key].(string); ok {
 					return value
@@ -168,28 +454,53 @@ func (h *Hook) getCredentials() *credentials {
 			}
 
 			creds := &credentials{
-				ServiceName:       service.Name,
-				EnvironmentID:     queryString("environmentid"),
-				APIToken:          queryString("apitoken"),
-				APIURL:            queryString("apiurl"),
-				CustomOneAgentURL: queryString("customoneagenturl"),
-				SkipErrors:        queryString("skiperrors") == "true",
-				NetworkZone:       queryString("networkzone"),
-				EnableFIPS:        queryString("enablefips") == "true",
-				AddTechnologies:      queryString("addtechnologies"),
+				ServiceName:               service.Name,
+				Source:                    source.Name(),
+				EnvironmentID:             queryString("environmentid"),
+				APIToken:                  queryString("apitoken"),
+				APIURL:                    queryString("apiurl"),
+				CustomOneAgentURL:         queryString("customoneagenturl"),
+				SkipErrors:                queryString("skiperrors") == "true",
+				NetworkZone:               queryString("networkzone"),
+				EnableFIPS:                queryString("enablefips") == "true",
+				AddTechnologies:           queryString("addtechnologies"),
+				AgentVersion:              queryString("agentversion"),
+				Flavor:                    queryString("flavor"),
+				InstallerChecksum:         queryString("installerchecksum"),
+				InstallerCertificate:      queryString("installercert"),
+				SkipSignatureVerification: queryString("skipsignatureverification") == "true",
+				DeploymentEvent:           queryString("deploymentevent") == "true",
+				EventSelector:             queryString("eventselector"),
+				Mode:                      queryString("mode"),
+				ReleaseProduct:            queryString("releaseproduct"),
+				ReleaseVersion:            queryString("releaseversion"),
+				ReleaseStage:              queryString("releasestage"),
+				ReleaseBuildVersion:       queryString("releasebuildversion"),
+				CACert:                    queryString("cacert"),
+				ClientCert:                queryString("clientcert"),
+				ClientKey:                 queryString("clientkey"),
+				InjectCACert:              queryString("injectcacert") == "true",
+				Proxy:                     queryString("proxy"),
+				DownloadProxy:             queryString("downloadproxy"),
+				Timeout:                   queryString("timeout"),
+				AgentConfig:               service.Credentials["agentconfig"],
 			}
 
 			if (creds.EnvironmentID != "" && creds.APIToken != "") || creds.CustomOneAgentURL != "" {
 				found = append(found, creds)
 			} else if !(creds.EnvironmentID == "" && creds.APIToken == "") { // One of the fields is empty.
-				h.Log.Warning("Incomplete credentials for service: %s, environment ID: %s, API token: %s", creds.ServiceName,
-					creds.EnvironmentID, creds.APIToken)
+				h.Log.Warning("Incomplete credentials for service: %s, environment ID: %s, API token set: %t", creds.ServiceName,
+					creds.EnvironmentID, creds.APIToken != "")
 			}
 		}
+
+		if len(found) > 0 {
+			break
+		}
 	}
 
 	if len(found) == 1 {
-		h.Log.Debug("Found one matching service: %s", found[0].ServiceName)
+		h.Log.Debug("Found one matching service: %s (%s)", found[0].ServiceName, found[0].Source)
 		return found[0]
 	}
 
@@ -200,83 +511,204 @@ func (h *Hook) getCredentials() *credentials {
 	return nil
 }
 
-// download gets url, and stores it as filePath, retrying a few more times if the downloads fail.
-func (h *Hook) download(url, filePath string, stager *libbuildpack.Stager, creds *credentials) error {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	if creds.CustomOneAgentURL == "" {
+// newAPIRequest creates a request for url. Requests against the tenant carry the API token and a User-Agent
+// identifying the buildpack, while requests against a custom OneAgent URL are sent as-is. It fails if url is invalid,
+// which retrying can't resolve.
+func (h *Hook) newAPIRequest(ctx context.Context, method, url string, body io.Reader, stager Stager, creds *credentials) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, permanent(redactURLError(err))
+	}
+	if url != creds.CustomOneAgentURL {
 		ver, err := stager.BuildpackVersion()
-			if err != nil {
-				h.Log.Warning("Failed to get buildpack version: %v", err)
-				ver = "unknown"
-			}
+		if err != nil {
+			h.Log.Warning("Failed to get buildpack version: %v", err)
+			ver = "unknown"
+		}
 		req.Header.Set("User-Agent", fmt.Sprintf("cf-%s-buildpack/%s", stager.BuildpackLanguage(), ver))
 		req.Header.Set("Authorization", fmt.Sprintf("Api-Token %s", creds.APIToken))
 	}
+	return req, nil
+}
+
+// download gets url, and stores it as filePath, retrying a few more times if the downloads fail. Interrupted downloads
+// are resumed where they stopped if the server supports range requests. If entry holds a previously downloaded
+// installer, the request is made conditional, and filePath is kept as-is when the server reports it as not modified.
+func (h *Hook) download(ctx context.Context, url, filePath string, stager Stager, creds *credentials, entry *cacheEntry) error {
+	client := h.newDownloadClient(creds)
+	conditional := entry != nil && entry.valid(filepath.Base(filePath))
 
-	out, err := os.Create(filePath)
+	// We download into a temporary file first, so that a failed download never replaces a good (cached) installer.
+	partFilePath := filePath + ".part"
+	out, err := os.Create(partFilePath)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(partFilePath)
 	defer out.Close()
-	
-	const baseWaitTime = 3 * time.Second
-	for i := 0; ; i++ {
+
+	notModified := false
+	partial := &partialDownload{total: -1}
+	err = h.withRetries(ctx, "installer download", func() error {
+		req, err := h.newAPIRequest(ctx, "GET", url, nil, stager, creds)
+		if err != nil {
+			return err
+		}
+		resuming := partial.resumable()
+		if resuming {
+			partial.setRangeHeaders(req)
+		} else if conditional {
+			if entry.ETag != "" {
+				req.Header.Set("If-None-Match", entry.ETag)
+			}
+			if entry.LastModified != "" {
+				req.Header.Set("If-Modified-Since", entry.LastModified)
+			}
+		}
+
 		resp, err := client.Do(req)
-		if err == nil {
-			// We truncate the file to make it empty, we also need to move the offset to the beginning. For errors
-			// here, these would be unexpected so we just fail the function without retrying.
+		if err != nil {
+			h.Log.Debug("Download failed: %v", err)
+			return err
+		}
+		defer resp.Body.Close() // Ignore error, nothing worth doing if it fails.
+
+		// The part we already got doesn't fit the installer anymore, e.g. because it's longer. We drop it and download
+		// the whole installer right away, the request as such didn't fail.
+		if resuming && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			h.Log.Debug("Server can't continue the installer download at %s, restarting download", formatBytes(partial.offset))
+			*partial = partialDownload{total: -1}
+			resuming = false
 
-			if err = out.Truncate(0); err != nil {
-				resp.Body.Close()
+			if req, err = h.newAPIRequest(ctx, "GET", url, nil, stager, creds); err != nil {
 				return err
 			}
-
-			if _, err = out.Seek(0, io.SeekStart); err != nil {
-				resp.Body.Close()
+			resp, err = client.Do(req)
+			if err != nil {
+				h.Log.Debug("Download failed: %v", err)
 				return err
 			}
+			defer resp.Body.Close() // Ignore error, nothing worth doing if it fails.
+		}
 
-			// Now we copy the response content into the file.
-			_, err = io.Copy(out, resp.Body)
+		if conditional && !resuming && resp.StatusCode == http.StatusNotModified {
+			notModified = true
+			return nil
+		}
+		if err := checkResponse(resp); err != nil {
+			h.Log.Debug("Download returned with status %s", resp.Status)
+			return err
+		}
 
-			resp.Body.Close() // Ignore error, nothing worth doing if it fails.
+		if resuming && partial.resumes(resp) {
+			h.Log.Info("Resuming installer download at %s", formatBytes(partial.offset))
+		} else {
+			if resuming {
+				h.Log.Debug("Server sent the whole installer, restarting download")
+			}
+			partial.start(resp)
 
-			if resp.StatusCode < 400 && err == nil {
-				return nil
+			// We truncate the file to make it empty. For errors here, these would be unexpected so we just fail
+			// without retrying.
+			if err := out.Truncate(0); err != nil {
+				return permanent(err)
 			}
+		}
 
-			h.Log.Debug("Download returned with status %s, error: %v", resp.Status, err)
+		// We continue writing where the last attempt stopped, or at the beginning.
+		if _, err := out.Seek(partial.offset, io.SeekStart); err != nil {
+			return permanent(err)
+		}
 
-			if i == h.MaxDownloadRetries {
-				h.Log.Warning("Maximum number of retries attempted: %d", h.MaxDownloadRetries)
-				return fmt.Errorf("download returned with status %s, error: %v", resp.Status, err)
-			}
-		} else {
-			h.Log.Debug("Download failed: %v", err)
+		// Now we copy the response content into the file.
+		progress := newDownloadProgress(h.Log, downloadProgressInterval, partial.offset, partial.total)
+		n, err := io.Copy(io.MultiWriter(out, progress), resp.Body)
+		partial.offset += n
+		if err != nil {
+			h.Log.Debug("Download failed after %s: %v", formatBytes(partial.offset), err)
+			return err
+		}
 
-			if i == h.MaxDownloadRetries {
-				h.Log.Warning("Maximum number of retries attempted: %d", h.MaxDownloadRetries)
-				return err
-			}
+		h.Log.Debug("Downloaded %s", progress.describe(time.Now()))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if entry != nil && !notModified {
+		entry.ETag = partial.etag
+		entry.LastModified = partial.lastModified
+	}
+
+	if notModified {
+		h.Log.Info("Installer not modified since last download, using cached installer")
+		return nil
+	}
+
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partFilePath, filePath)
+}
+
+// getInstallerType returns the OS and installer type path segments of the deployment API for the current platform.
+func (h *Hook) getInstallerType() (osType, installerType string) {
+	if h.getOS() == osLinux {
+		return "unix", "paas-sh"
+	} else if h.getOS() == osWindows {
+		return "windows", "paas"
+	}
+	return "", ""
+}
+
+// getLatestAgentVersion asks the deployment API for the version the 'latest' installer resolves to. It returns an
+// empty string if the version can't be determined, e.g. because a custom OneAgent URL is used.
+func (h *Hook) getLatestAgentVersion(ctx context.Context, creds *credentials, stager Stager) string {
+	if creds.CustomOneAgentURL != "" {
+		return ""
+	}
+
+	apiURL, err := h.ensureApiURL(creds)
+	if err != nil {
+		return ""
+	}
+
+	osType, installerType := h.getInstallerType()
+	metaInfoURL := fmt.Sprintf("%s/v1/deployment/installer/agent/%s/%s/latest/metainfo", apiURL, osType, installerType)
+
+	client := h.newHTTPClient(creds, 3*time.Second)
+
+	var metaInfo struct {
+		LatestAgentVersion string `json:"latestAgentVersion"`
+	}
+	// The version only makes the installer cache more precise, so it's not worth holding up the staging with retries.
+	err = func() error {
+		req, err := h.newAPIRequest(ctx, "GET", metaInfoURL, nil, stager, creds)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
 		}
+		defer resp.Body.Close()
 
-		waitTime := baseWaitTime + time.Duration(math.Pow(2, float64(i)))*time.Second
-		h.Log.Warning("Error during installer download, retrying in %v", waitTime)
-		time.Sleep(waitTime)
+		if err := checkResponse(resp); err != nil {
+			return err
+		}
+		return json.NewDecoder(resp.Body).Decode(&metaInfo)
+	}()
+	if err != nil {
+		h.Log.Debug("Failed to resolve latest OneAgent version: %v", err)
+		return ""
 	}
 
+	return metaInfo.LatestAgentVersion
 }
 
 func (h *Hook) getDownloadURL(c *credentials) string {
-	var osType, installerType string
-	if runtime.GOOS == "linux" {
-		osType = "unix"
-		installerType = "paas-sh"
-	} else if runtime.GOOS == "windows" {
-		osType = "windows"
-		installerType = "paas"
-	}
+	osType, installerType := h.getInstallerType()
 
 	if c.CustomOneAgentURL != "" {
 		return c.CustomOneAgentURL
@@ -287,13 +719,27 @@ func (h *Hook) getDownloadURL(c *credentials) string {
 		return ""
 	}
 
-	u, err := url.ParseRequestURI(fmt.Sprintf("%s/v1/deployment/installer/agent/%s/%s/latest", apiURL, osType, installerType))
+	// download a specific version if one is pinned, the version has already been resolved at this point
+	versionPath := "latest"
+	if c.AgentVersion != "" {
+		versionPath = "version/" + url.PathEscape(c.AgentVersion)
+	}
+
+	u, err := url.ParseRequestURI(fmt.Sprintf("%s/v1/deployment/installer/agent/%s/%s/%s", apiURL, osType, installerType, versionPath))
 	if err != nil {
 		return ""
 	}
 
 	qv := make(url.Values)
 	qv.Add("bitness", "64")
+	// only set the arch property for non-x86 platforms, x86 is the default
+	if h.getOS() == osLinux && h.getArchitecture() != archX86 {
+		qv.Add("arch", h.getArchitecture())
+	}
+	// only set the flavor property for non-default flavors
+	if c.Flavor != "" && c.Flavor != flavorDefault {
+		qv.Add("flavor", c.Flavor)
+	}
 	// only set the networkzone property when it is configured
 	if c.NetworkZone != "" {
 		qv.Add("networkZone", c.NetworkZone)
@@ -351,7 +797,7 @@ func (h *Hook) findAgentPath(installDir string, technology string, binaryType st
 		Technologies Technologies `json:"technologies"`
 	}
 
-	fallbackPath := filepath.Join("agent", "lib64", libraryFilename)
+	fallbackPath := getFallbackAgentPath(platformName, libraryFilename)
 
 	manifestPath := filepath.Join(installDir, "manifest.json")
 	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
@@ -378,66 +824,75 @@ func (h *Hook) findAgentPath(installDir string, technology string, binaryType st
 	return fallbackPath, nil
 }
 
-// Downloads most recent agent config from configuration API of the tenant
-// and merges it with the local version the standalone installer package brings along.
-func (h *Hook) updateAgentConfig(creds *credentials, installDir string, stager *libbuildpack.Stager) error {
-	// agentConfigProperty represents a line of raw data we get from the config api
-	type agentConfigProperty struct {
-		Section string
-		Key     string
-		Value   string
-	}
+// apiConfigProperty represents a line of raw data we get from the config api
+type apiConfigProperty struct {
+	Section string
+	Key     string
+	Value   string
+}
 
-	// Container type for agentConfigProperty.
+// fetchAgentConfig downloads the most recent OneAgent config from the configuration API of the tenant.
+func (h *Hook) fetchAgentConfig(ctx context.Context, creds *credentials, stager Stager) ([]apiConfigProperty, error) {
+	// Container type for apiConfigProperty.
 	// Used for easy unmarshalling.
 	type properties struct {
-		Properties []agentConfigProperty
+		Properties []apiConfigProperty
 	}
 
 	// Fetch most recent OneAgent config from API, which we get back in JSON format
 	// According to the API spec it always returns at least some sort of Header Info.
 	// So, we do not need to handle the case that the request succeeds and the content is empty.
-	client := &http.Client{Timeout: 3 * time.Second}
+	client := h.newHTTPClient(creds, 3*time.Second)
 	apiURL, err := h.ensureApiURL(creds)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	agentConfigUrl := apiURL + "/v1/deployment/installer/agent/processmoduleconfig"
 
-	lang := stager.BuildpackLanguage()
-	ver, err := stager.BuildpackVersion()
+	h.Log.Debug("Downloading updated OneAgent config from %s", agentConfigUrl)
+
+	var jsonConfig properties
+	err = h.withRetries(ctx, "OneAgent config download", func() error {
+		req, err := h.newAPIRequest(ctx, "GET", agentConfigUrl, nil, stager, creds)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if err := checkResponse(resp); err != nil {
+			return err
+		}
+		json.NewDecoder(resp.Body).Decode(&jsonConfig)
+		return nil
+	})
 	if err != nil {
-		h.Log.Warning("Failed to get buildpack version: %v", err)
-		ver = "unknown"
+		return nil, err
 	}
 
-	h.Log.Debug("Downloading updated OneAgent config from %s", agentConfigUrl)
-	req, _ := http.NewRequest("GET", agentConfigUrl, nil)
-	req.Header.Set("User-Agent", fmt.Sprintf("cf-%s-buildpack/%s", lang, ver))
-	req.Header.Set("Authorization", fmt.Sprintf("Api-Token %s", creds.APIToken))
-	client.Do(req)
-	resp, err := client.Do(req)
+	return jsonConfig.Properties, nil
+}
+
+// Downloads most recent agent config from configuration API of the tenant, unless it was fetched in the background
+// already, and merges it with the local version the standalone installer package brings along.
+func (h *Hook) updateAgentConfig(ctx context.Context, creds *credentials, installDir string, stager Stager, report *stagingReport, prefetched *prefetch) error {
+	configFromAPI, ok, err := prefetched.agentConfig()
+	if !ok {
+		configFromAPI, err = h.fetchAgentConfig(ctx, creds, stager)
+	}
 
 	configComment := ""
-	configFromAPI := make(map[string]map[string]string)
-	if err != nil || resp.StatusCode != 200 {
+	if err != nil {
+		h.Log.Debug("Failed to fetch updated OneAgent config: %s", err)
 		h.Log.Warning("Failed to fetch updated OneAgent config from the API")
 		configComment = "# Warning: Failed to fetch updated OneAgent config from the API. This config only includes settings provided by the installer.\n"
 	} else {
 		h.Log.Debug("Successfully fetched updated OneAgent config from the API")
 		configComment = "# This config is a merge between the installer and the Cluster config\n"
-		var jsonConfig properties
-		json.NewDecoder(resp.Body).Decode(&jsonConfig)
-
-		for _, v := range jsonConfig.Properties {
-			// you gotta check if the required map is already there
-			// if not: initialize it with a nice make :-)
-			_, ok := configFromAPI[v.Section]
-			if !ok {
-				configFromAPI[v.Section] = make(map[string]string)
-			}
-			configFromAPI[v.Section][v.Key] = v.Value
-		}
+		report.setConfigMerged(true)
 	}
 
 	// read data from ruxitagentproc.conf file
@@ -448,65 +903,47 @@ func (h *Hook) updateAgentConfig(creds *credentials, installDir string, stager *
 		return err
 	}
 	h.Log.Debug("Successfully read OneAgent config from %s", agentConfigPath)
-	defer agentConfigFile.Close()
-
-	configFromAgent := make(map[string]map[string]string)
-	currentSection := ""
-	var configSection string
-	var sectionRegexp, _ = regexp.Compile(`\[(.*)\]`)
-	configScanner := bufio.NewScanner(agentConfigFile)
 
 	h.Log.Debug("Starting to parse OneAgent config...")
-	for configScanner.Scan() {
-		// This parses the data we retrieved from ruxitagentproc.conf and stores
-		// it into the configFromAgent map of maps that was created above, for easy
-		// merging with configFromAPI later on.
-		currentLine := configScanner.Text()
-
-		// Check if current line is a section header
-		if sectionHeader := sectionRegexp.FindStringSubmatch(currentLine); len(sectionHeader) != 0 {
-			configSection = sectionHeader[1]
-		} else {
-			configSection = ""
-		}
-
-		if configSection != "" {
-			currentSection = configSection
-		} else if strings.HasPrefix(currentLine, "#") { //it's a comment line
-			// skipping over lines that are purely comments
-			continue
-		} else if currentLine == "" {
-			// skipping over empty lines
-			continue
-		} else {
-			// you gotta check if the required map is already there
-			// if not: initialize it with a nice make :-)
-			_, ok := configFromAgent[currentSection]
-			if !ok {
-				configFromAgent[currentSection] = make(map[string]string)
-			}
-			configLineKey := strings.Fields(currentLine)[0]
-			configLineValue := strings.Join(strings.Fields(currentLine)[1:], " ")
-			configFromAgent[currentSection][configLineKey] = configLineValue
-		}
+	config, err := parseAgentConfig(agentConfigFile)
+	agentConfigFile.Close()
+	if err != nil {
+		h.Log.Error("Failure while parsing OneAgent config file %s: %s", agentConfigPath, err)
+		return err
 	}
 	h.Log.Debug("Successfully parsed OneAgent config...")
 
 	// Merge the two configs to get an updated version.
 	// Just writes all of configFromAPI over eventually existing values in
-	// configFromAgent, since the ones from the API are supposed to be the recent ones.
-	// This includes adding possibly new sections and/or property keys.
+	// the installer's config, since the ones from the API are supposed to be the recent ones.
+	// This includes adding possibly new sections and/or property keys, in the order the API returns them.
 	h.Log.Debug("Starting with OneAgent configuration merging...")
-	for section := range configFromAPI {
-		for property := range configFromAPI[section] {
-			_, ok := configFromAgent[section]
-			if !ok {
-				configFromAgent[section] = make(map[string]string)
+	for _, v := range configFromAPI {
+		config.Set(v.Section, v.Key, v.Value)
+	}
+	h.Log.Debug("Finished OneAgent configuration merging")
+
+	h.setAgentProxy(creds, config)
+
+	// Overrides from the service credentials take precedence over both, the installer's and the API's config.
+	overrides, err := parseAgentConfigOverrides(creds.AgentConfig)
+	if err != nil {
+		h.Log.Error("Failed to apply OneAgent config overrides: %s", err)
+		return err
+	}
+	if len(overrides) > 0 {
+		// Only the keys are logged, as the values may hold secrets like proxy credentials.
+		h.Log.Info("Applying OneAgent config overrides from service credentials:")
+		for _, o := range overrides {
+			if o.value == nil {
+				config.Delete(o.section, o.key)
+				h.Log.Info("  [%s] %s removed", o.section, o.key)
+			} else {
+				config.Set(o.section, o.key, *o.value)
+				h.Log.Info("  [%s] %s set", o.section, o.key)
 			}
-			configFromAgent[section][property] = configFromAPI[section][property]
 		}
 	}
-	h.Log.Debug("Finished OneAgent configuration merging")
 
 	// open ruxitagentproc.conf to overwrite its content
 	overwriteAgentConfigFile, err := os.Create(agentConfigPath)
@@ -518,17 +955,14 @@ func (h *Hook) updateAgentConfig(creds *credentials, installDir string, stager *
 	defer overwriteAgentConfigFile.Close()
 
 	// Write additional comments to the config
-	fmt.Fprintf(overwriteAgentConfigFile, configComment)
+	if _, err := io.WriteString(overwriteAgentConfigFile, configComment); err != nil {
+		return err
+	}
 
 	// write merged data to ruxitagentproc.conf
-	for section := range configFromAgent {
-		fmt.Fprintf(overwriteAgentConfigFile, "[%s]\n", section)
-		for k, v := range configFromAgent[section] {
-			fmt.Fprintf(overwriteAgentConfigFile, "%s %s\n", k, v)
-		}
-
-		// Trailing empty newline at the end of each section for better human readability
-		fmt.Fprintf(overwriteAgentConfigFile, "\n")
+	if _, err := config.WriteTo(overwriteAgentConfigFile); err != nil {
+		h.Log.Error("Error writing OneAgent config file %s: %s", agentConfigPath, err)
+		return err
 	}
 
 	h.Log.Debug("Finished writing updated OneAgent config back to %s", agentConfigPath)
@@ -0,0 +1,75 @@
+package dynatrace_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+)
+
+// archiveEntry is a file, directory or link for test installers and archives.
+type archiveEntry struct {
+	name     string
+	body     string
+	linkname string
+	typeflag byte
+}
+
+// makePaaSInstaller builds a self-extracting paas-sh installer: the shell script header, followed by the gzipped tar
+// archive with the given entries.
+func makePaaSInstaller(header string, entries []archiveEntry) string {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Linkname: e.linkname, Typeflag: e.typeflag, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			panic(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); hdr.Size > 0 && err != nil {
+			panic(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	if err := gz.Close(); err != nil {
+		panic(err)
+	}
+
+	return header + archive.String()
+}
+
+// makeZip builds a zip archive, as used for Windows installers, with the given files.
+func makeZip(entries []archiveEntry) []byte {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := w.Write([]byte(e.body)); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+
+	return archive.Bytes()
+}
@@ -0,0 +1,116 @@
+package dynatrace
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	modeOneAgent = "oneagent"
+	modeOTel     = "otel"
+)
+
+// otlpProtocol is the only OTLP protocol the Dynatrace API supports.
+const otlpProtocol = "http/protobuf"
+
+// otelVariable is an environment variable set up for OpenTelemetry export. secret is set for values which must neither
+// be logged nor written to the staging report.
+type otelVariable struct {
+	name   string
+	value  string
+	secret bool
+}
+
+// getMode returns how the app is monitored: by injecting OneAgent, or by exporting the app's OpenTelemetry data.
+func getMode(creds *credentials) (string, error) {
+	switch creds.Mode {
+	case "", modeOneAgent:
+		return modeOneAgent, nil
+	case modeOTel:
+		return modeOTel, nil
+	}
+	return "", errors.New("unsupported mode: " + creds.Mode)
+}
+
+// setUpOTelExport writes a profile.d script configuring the OpenTelemetry SDKs in the app to export to the tenant,
+// instead of installing OneAgent.
+func (h *Hook) setUpOTelExport(creds *credentials, stager Stager, report *stagingReport) error {
+	if creds.APIToken == "" {
+		return errors.New("otel mode requires an apitoken")
+	}
+
+	apiURL, err := h.ensureApiURL(creds)
+	if err != nil {
+		return err
+	}
+
+	var filename, script string
+	if h.getOS() == osWindows {
+		filename = "dynatrace-otel.cmd"
+		cmdEscape := strings.NewReplacer("%", "%%", "^", "^^", "&", "^&", "|", "^|", "<", "^<", ">", "^>").Replace
+		for _, v := range h.getOTelVariables(creds, apiURL, cmdEscape, func(name string) string { return "%" + name + "%" }) {
+			script += fmt.Sprintf("if not defined %s set \"%s=%s\"\n", v.name, v.name, v.value)
+		}
+	} else {
+		filename = "dynatrace-otel.sh"
+		for _, v := range h.getOTelVariables(creds, apiURL, shellQuote, runtimeReference) {
+			script += fmt.Sprintf("export %s=\"${%s:-%s}\"\n", v.name, v.name, v.value)
+		}
+	}
+
+	h.Log.BeginStep("Setting up OpenTelemetry export to Dynatrace...")
+	for _, v := range h.getOTelVariables(creds, apiURL, func(s string) string { return s }, runtimeReference) {
+		if v.secret {
+			h.Log.Debug("Setting %s...", v.name)
+			report.addEnv(v.name, redactedText)
+		} else {
+			h.Log.Debug("Setting %s to %s", v.name, v.value)
+			report.addEnv(v.name, v.value)
+		}
+	}
+
+	return stager.WriteProfileD(filename, script)
+}
+
+// getOTelVariables returns the OTEL_* variables to export to the OTLP endpoint of the tenant. Values known at staging
+// time are passed through escape, while values which differ between instances are referenced from the environment
+// through ref.
+func (h *Hook) getOTelVariables(creds *credentials, apiURL string, escape, ref func(string) string) []otelVariable {
+	var attributes []string
+	if app := h.getVCAPApplication(); app.ApplicationName != "" {
+		attributes = append(attributes, "service.name="+escape(percentEncode(app.ApplicationName)))
+	}
+	for _, e := range h.getMetadata() {
+		value := escape(percentEncode(e.value))
+		if e.runtimeVar != "" {
+			value = ref(e.runtimeVar)
+		}
+		attributes = append(attributes, e.key+"="+value)
+	}
+
+	vars := []otelVariable{
+		{name: "OTEL_EXPORTER_OTLP_ENDPOINT", value: escape(strings.TrimSuffix(apiURL, "/") + "/v2/otlp")},
+		{name: "OTEL_EXPORTER_OTLP_HEADERS", value: escape("Authorization=" + percentEncode("Api-Token "+creds.APIToken)), secret: true},
+		{name: "OTEL_EXPORTER_OTLP_PROTOCOL", value: escape(otlpProtocol)},
+	}
+	if len(attributes) > 0 {
+		vars = append(vars, otelVariable{name: "OTEL_RESOURCE_ATTRIBUTES", value: strings.Join(attributes, ",")})
+	}
+
+	return vars
+}
+
+// percentEncode encodes everything but unreserved characters, as required for the values of OTEL_EXPORTER_OTLP_HEADERS
+// and OTEL_RESOURCE_ATTRIBUTES.
+func percentEncode(s string) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b == '-' || b == '.' || b == '_' || b == '~' {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,247 @@
+package dynatrace
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxPaaSHeaderSize limits how much of the installer we read looking for the embedded archive. The shell part of
+// paas-sh installers is a few kilobytes, so anything beyond this isn't a format we know.
+const maxPaaSHeaderSize = 1 << 20
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+	// paasEnvVariables are the settings the installer puts into dynatrace-env.sh, assigned in the script's header.
+	paasEnvVariables   = []string{"DT_TENANT", "DT_TENANTTOKEN", "DT_CONNECTION_POINT"}
+	paasAssignmentLine = regexp.MustCompile(`^(?:readonly\s+|export\s+)?([A-Z_]+)=(.*)$`)
+)
+
+// errUnknownInstallerFormat is returned if the installer isn't a self-extracting paas-sh installer we understand.
+var errUnknownInstallerFormat = errors.New("unknown installer format")
+
+// paasInstaller is a self-extracting paas-sh installer: a shell script, followed by a gzipped tar archive holding
+// OneAgent, and optionally a signature.
+type paasInstaller struct {
+	path string
+
+	// offset is where the archive starts within the installer.
+	offset int64
+
+	// env holds the variables to write into dynatrace-env.sh, in the order of paasEnvVariables.
+	env [][2]string
+}
+
+// openPaaSInstaller locates the embedded archive in the installer. It returns errUnknownInstallerFormat if the
+// installer doesn't look as expected, so that the caller can fall back to running it.
+func openPaaSInstaller(path string) (*paasInstaller, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	installer := &paasInstaller{path: path}
+	assignments := map[string]string{}
+
+	for first := true; ; first = false {
+		if magic, _ := r.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+			break
+		}
+
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, errUnknownInstallerFormat
+		}
+		installer.offset += int64(len(line))
+
+		if installer.offset > maxPaaSHeaderSize || bytes.IndexByte(line, 0) != -1 || (first && !bytes.HasPrefix(line, []byte("#!"))) {
+			return nil, errUnknownInstallerFormat
+		}
+
+		if m := paasAssignmentLine.FindStringSubmatch(strings.TrimSpace(string(line))); m != nil {
+			assignments[m[1]] = strings.Trim(m[2], `"'`)
+		}
+	}
+
+	for _, name := range paasEnvVariables {
+		value, ok := assignments[name]
+		if !ok {
+			return nil, errUnknownInstallerFormat
+		}
+		installer.env = append(installer.env, [2]string{name, value})
+	}
+
+	return installer, nil
+}
+
+// archive returns a reader for the files in the embedded archive. Trailing data like the signature is ignored.
+func (p *paasInstaller) archive() (*tar.Reader, io.Closer, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := f.Seek(p.offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	gz.Multistream(false)
+
+	return tar.NewReader(gz), f, nil
+}
+
+// verify reads through the whole archive, so that a truncated or corrupted download is detected by the gzip checksum,
+// and checks every entry as well as the number and total size of the files before anything is written.
+func (p *paasInstaller) verify(ctx context.Context, targetDir string, maxSize int64, maxFiles int) error {
+	tr, closer, err := p.archive()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	guard := newArchiveGuard(targetDir)
+	var files int
+	var size int64
+	for {
+		if ctx.Err() != nil {
+			return contextError(ctx, "installer extraction")
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if files++; files > maxFiles {
+			return fmt.Errorf("archive has more than the limit of %d entries", maxFiles)
+		}
+
+		if _, err := guard.path(hdr.Name); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+		case tar.TypeReg:
+			if size += hdr.Size; size > maxSize {
+				return fmt.Errorf("archive extracts to more than the limit of %d bytes", maxSize)
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			if err := guard.link(hdr.Name, hdr.Linkname, hdr.Typeflag == tar.TypeSymlink); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported entry type for '%s' in installer archive", hdr.Name)
+		}
+
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// extract unpacks the archive into targetDir, and writes dynatrace-env.sh unless the archive brings it. As with zip
+// archives, everything is extracted into a temporary directory first, which is only renamed into place once complete.
+func (p *paasInstaller) extract(ctx context.Context, targetDir string, maxSize int64, maxFiles int) error {
+	if err := p.verify(ctx, targetDir, maxSize, maxFiles); err != nil {
+		return fmt.Errorf("invalid installer archive: %w", err)
+	}
+
+	tr, closer, err := p.archive()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	if err := os.MkdirAll(filepath.Dir(targetDir), 0755); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(targetDir), "."+filepath.Base(targetDir)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The entries were checked already, we only need the guard to map them again. The installer file could still have
+	// changed in between, so the size is checked again.
+	guard := newArchiveGuard(tmpDir)
+	remaining := maxSize
+	for {
+		if ctx.Err() != nil {
+			return contextError(ctx, "installer extraction")
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		target, err := guard.path(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			if remaining -= hdr.Size; remaining < 0 {
+				return errors.New("archive extracts to more than the size limit")
+			}
+			err = writeArchiveFile(target, tr, hdr.FileInfo().Mode().Perm())
+		case tar.TypeSymlink:
+			if err = guard.link(hdr.Name, hdr.Linkname, true); err == nil {
+				if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+					err = os.Symlink(hdr.Linkname, target)
+				}
+			}
+		case tar.TypeLink:
+			var linked string
+			if linked, err = guard.path(hdr.Linkname); err == nil {
+				if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+					err = os.Link(linked, target)
+				}
+			}
+		default:
+			err = fmt.Errorf("unsupported entry type for '%s' in installer archive", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	envPath := filepath.Join(tmpDir, "dynatrace-env.sh")
+	if _, err := os.Stat(envPath); os.IsNotExist(err) {
+		var env strings.Builder
+		for _, v := range p.env {
+			env.WriteString(fmt.Sprintf("export %s=\"%s\"\n", v[0], shellQuote(v[1])))
+		}
+		if err := os.WriteFile(envPath, []byte(env.String()), 0644); err != nil {
+			return err
+		}
+	}
+
+	return replaceDir(tmpDir, targetDir)
+}
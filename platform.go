@@ -0,0 +1,76 @@
+package dynatrace
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	archX86 = "x86"
+	archARM = "arm"
+)
+
+const (
+	osLinux   = "linux"
+	osWindows = "windows"
+)
+
+// getOS returns the operating system of the target platform. Stacks are named after it (e.g. cflinuxfs4,
+// windows2019), so that we can also stage Windows apps on Linux and vice versa.
+func (h *Hook) getOS() string {
+	if h.OS != "" {
+		return h.OS
+	}
+
+	stack := strings.ToLower(os.Getenv("CF_STACK"))
+	switch {
+	case strings.HasPrefix(stack, "windows"):
+		return osWindows
+	case strings.Contains(stack, "linux"):
+		return osLinux
+	}
+	return runtime.GOOS
+}
+
+// getArchitecture returns the CPU architecture of the target platform, as expected by the arch parameter of the
+// deployment API. Stacks can hint an ARM target through their name (e.g. cflinuxfs4-arm64), otherwise we assume the
+// architecture the buildpack is running on. Hook.Arch overrides both.
+func (h *Hook) getArchitecture() string {
+	if h.Arch != "" {
+		return h.Arch
+	}
+
+	stack := strings.ToLower(os.Getenv("CF_STACK"))
+	if strings.Contains(stack, "arm64") || strings.Contains(stack, "aarch64") {
+		return archARM
+	}
+
+	if runtime.GOARCH == "arm64" {
+		return archARM
+	}
+	return archX86
+}
+
+// getPlatformName returns the key identifying the target platform in the manifest.json of the OneAgent package, e.g.
+// linux-x86-64, linux-arm-64 or linux-musl-x86-64.
+func (h *Hook) getPlatformName(osName string, musl bool) string {
+	if musl {
+		osName += "-musl"
+	}
+	if h.getArchitecture() == archARM {
+		return osName + "-arm-64"
+	}
+	return osName + "-x86-64"
+}
+
+// getFallbackAgentPath returns the path of an agent library relative to the install directory, for packages where we
+// can't find it through the manifest.json. Only the default x86 libraries are found in lib64, others (including musl
+// ones) are below bin.
+func getFallbackAgentPath(platformName, libraryFilename string) string {
+	if platformName == "linux-x86-64" || platformName == "windows-x86-64" {
+		return filepath.Join("agent", "lib64", libraryFilename)
+	}
+	return filepath.Join("agent", "bin", platformName, libraryFilename)
+}
@@ -0,0 +1,168 @@
+package dynatrace
+
+import (
+	"context"
+	"io"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// prefetch holds the results of the work started in the background by BeforeCompile: resolving the agent version,
+// downloading the installer and fetching the OneAgent config from the tenant. This happens while the app is compiled,
+// and AfterCompile picks up the results. The background work logs right away, so that the progress of the download
+// shows while the app compiles, but through the same redactor as install.
+type prefetch struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	// agentVersion is the agentversion setting, and version what it was resolved to.
+	agentVersion string
+	version      string
+
+	downloadURL   string
+	installerPath string
+	downloadErr   error
+
+	configFetched bool
+	config        []apiConfigProperty
+	configErr     error
+}
+
+// BeforeCompile starts downloading the Dynatrace agent in the background, so that the download overlaps with the
+// compile step. AfterCompile waits for it to finish.
+func (h *Hook) BeforeCompile(stager *libbuildpack.Stager) error {
+	h.startPrefetch(stager)
+	return nil
+}
+
+// startPrefetch starts the background download if there are credentials for OneAgent installation. Any problem is
+// left to install to run into again, and to handle according to the credentials.
+func (h *Hook) startPrefetch(stager Stager) {
+	// install looks up the credentials and sets up the hook from them again, and logs about it. Doing so quietly here
+	// keeps the output from appearing twice.
+	quiet := *h
+	quiet.Log = libbuildpack.NewLogger(io.Discard)
+	creds := quiet.getCredentials()
+	if creds == nil {
+		return
+	}
+
+	timeout, mode, _, err := quiet.setUp(creds)
+	if err != nil || mode != modeOneAgent {
+		return
+	}
+
+	var installerFilename string
+	if h.getOS() == osLinux {
+		installerFilename = "paasInstaller.sh"
+	} else if h.getOS() == osWindows {
+		installerFilename = "paasInstaller.zip"
+	} else {
+		return
+	}
+
+	// The background work is stopped if AfterCompile runs out of time waiting for it, and is limited by the timeout
+	// for setting up Dynatrace itself.
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	p := &prefetch{done: make(chan struct{}), cancel: cancel, agentVersion: creds.AgentVersion}
+	h.redactLog(creds.secrets()...)
+	h.prefetched = p
+
+	// The background work uses its own copy of the hook, sharing the redacted logger with it.
+	bg := *h
+	bg.prefetched = nil
+
+	go func() {
+		defer close(p.done)
+		bg.runPrefetch(ctx, p, installerFilename, creds, stager)
+	}()
+}
+
+func (h *Hook) runPrefetch(ctx context.Context, p *prefetch, installerFilename string, creds *credentials, stager Stager) {
+	h.Log.Debug("Prefetching OneAgent installer during compilation...")
+
+	if creds.AgentVersion != "" && creds.CustomOneAgentURL == "" {
+		version, err := h.resolveAgentVersion(ctx, creds, stager)
+		if err != nil {
+			h.Log.Debug("Failed to resolve OneAgent version, not prefetching the installer: %s", err)
+			return
+		}
+		p.version = version
+		creds.AgentVersion = version
+	}
+
+	// The compile step may still add binaries, so the flavor is detected again before the prefetched installer is used.
+	if h.getOS() == osLinux && creds.CustomOneAgentURL == "" {
+		flavor, err := h.getFlavor(creds, stager.BuildDir())
+		if err != nil {
+			h.Log.Debug("Failed to select OneAgent flavor, not prefetching the installer: %s", err)
+			return
+		}
+		creds.Flavor = flavor
+	}
+
+	p.config, p.configErr = h.fetchAgentConfig(ctx, creds, stager)
+	p.configFetched = true
+
+	p.downloadURL = h.getDownloadURL(creds)
+	p.installerPath, p.downloadErr = h.downloadInstaller(ctx, p.downloadURL, installerFilename, creds, stager)
+}
+
+// joinPrefetch waits for the background work started by BeforeCompile, if any, and returns its results.
+func (h *Hook) joinPrefetch(ctx context.Context) *prefetch {
+	p := h.prefetched
+	if p == nil {
+		return nil
+	}
+
+	h.Log.Debug("Waiting for OneAgent installer download started during compilation...")
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		h.Log.Debug("Stopping OneAgent installer download started during compilation...")
+	}
+	h.stopPrefetch()
+
+	return p
+}
+
+// stopPrefetch cancels the background work started by BeforeCompile, if it's still running, and waits for it to stop.
+func (h *Hook) stopPrefetch() {
+	p := h.prefetched
+	if p == nil {
+		return
+	}
+	h.prefetched = nil
+
+	p.cancel()
+	<-p.done
+}
+
+// resolvedVersion returns the version agentVersion was resolved to in the background, or an empty string if it wasn't.
+func (p *prefetch) resolvedVersion(agentVersion string) string {
+	if p == nil || p.agentVersion != agentVersion {
+		return ""
+	}
+	return p.version
+}
+
+// installer returns the outcome of downloading downloadURL in the background. ok is false if nothing or a different
+// installer was downloaded, e.g. because the flavor detected after compilation differs.
+func (p *prefetch) installer(downloadURL string) (path string, ok bool, err error) {
+	if p == nil || p.downloadURL == "" || p.downloadURL != downloadURL {
+		return "", false, nil
+	}
+	return p.installerPath, true, p.downloadErr
+}
+
+// agentConfig returns the OneAgent config fetched in the background. ok is false if it wasn't fetched.
+func (p *prefetch) agentConfig() (config []apiConfigProperty, ok bool, err error) {
+	if p == nil || !p.configFetched {
+		return nil, false, nil
+	}
+	return p.config, true, p.configErr
+}
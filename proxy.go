@@ -0,0 +1,116 @@
+package dynatrace
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// agentProxySection and agentProxyKey locate the proxy OneAgent uses at runtime in ruxitagentproc.conf.
+const (
+	agentProxySection = "general"
+	agentProxyKey     = "proxy"
+)
+
+// parseProxy parses a proxy setting. Proxies given as host:port are assumed to be HTTP proxies.
+func parseProxy(name, value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, redactURL(value))
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported scheme for %s: %s", name, u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid %s: %s", name, redactURL(value))
+	}
+
+	return u, nil
+}
+
+// setUpProxy parses the proxy settings from the credentials. The installer is downloaded through the downloadproxy if
+// set, and through the proxy otherwise. Without any, the proxy from the environment of the staging container is used.
+func (h *Hook) setUpProxy(creds *credentials) error {
+	if creds.Proxy != "" {
+		u, err := parseProxy("proxy", creds.Proxy)
+		if err != nil {
+			return err
+		}
+		h.Log.Debug("Using proxy %s", redactURL(u.String()))
+		creds.proxyURL = u
+		creds.downloadProxyURL = u
+	}
+
+	if creds.DownloadProxy != "" {
+		u, err := parseProxy("downloadproxy", creds.DownloadProxy)
+		if err != nil {
+			return err
+		}
+		h.Log.Debug("Using proxy %s for the installer download", redactURL(u.String()))
+		creds.downloadProxyURL = u
+	}
+
+	return nil
+}
+
+// newTransport returns a transport with the TLS settings from the credentials and the given proxy, or nil if neither
+// is configured, so that the default transport is used.
+func newTransport(creds *credentials, proxy *url.URL) http.RoundTripper {
+	if creds.tlsConfig == nil && proxy == nil {
+		return nil
+	}
+
+	// We keep the settings of the default transport, like the proxy from the environment, if we can.
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if ok {
+		transport = transport.Clone()
+	} else {
+		transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+
+	if creds.tlsConfig != nil {
+		transport.TLSClientConfig = creds.tlsConfig
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return transport
+}
+
+// newHTTPClient returns a client for requests against the tenant, using the TLS and proxy settings from the
+// credentials. A zero timeout means no timeout.
+func (h *Hook) newHTTPClient(creds *credentials, timeout time.Duration) *http.Client {
+	if creds.transport == nil {
+		creds.transport = newTransport(creds, creds.proxyURL)
+	}
+	return &http.Client{Transport: creds.transport, Timeout: timeout}
+}
+
+// newDownloadClient returns a client for downloading the installer from the tenant or the OneAgent mirror.
+func (h *Hook) newDownloadClient(creds *credentials) *http.Client {
+	if creds.downloadTransport == nil {
+		creds.downloadTransport = newTransport(creds, creds.downloadProxyURL)
+	}
+	return &http.Client{Transport: creds.downloadTransport}
+}
+
+// setAgentProxy configures the proxy OneAgent uses at runtime.
+func (h *Hook) setAgentProxy(creds *credentials, config *agentConfig) {
+	if creds.proxyURL == nil {
+		return
+	}
+
+	h.Log.Info("Configuring OneAgent to use proxy %s", redactURL(creds.proxyURL.String()))
+	config.Set(agentProxySection, agentProxyKey, creds.proxyURL.String())
+}
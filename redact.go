@@ -0,0 +1,137 @@
+package dynatrace
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// redactedText replaces secrets in the output.
+const redactedText = "***"
+
+var (
+	// tokenPattern matches Dynatrace access tokens, e.g. dt0c01.ABC.DEF.
+	tokenPattern = regexp.MustCompile(`dt0[a-z][0-9]{2}\.[A-Za-z0-9_\-.]+`)
+
+	// authorizationPattern matches authorization headers or query parameters, keeping the scheme.
+	authorizationPattern = regexp.MustCompile(`(?i)((?:authorization|api-token)\s*[:=]\s*(?:(?:api-token|bearer|basic)\s+)?)[^\s"',&]+`)
+)
+
+// redactor is an io.Writer which masks secrets before passing the output on. Output is buffered until the end of a
+// line, so that secrets split across writes are still found. Flush writes out what's left in the buffer.
+type redactor struct {
+	mu      sync.Mutex
+	w       io.Writer
+	buf     []byte
+	secrets []string
+}
+
+func newRedactor(w io.Writer) *redactor {
+	return &redactor{w: w}
+}
+
+// addSecrets registers additional values to mask.
+func (r *redactor) addSecrets(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range secrets {
+		if s == "" {
+			continue
+		}
+		r.secrets = append(r.secrets, s)
+	}
+
+	// Longer secrets first, so that secrets containing other secrets are fully masked.
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf = append(r.buf, p...)
+
+	i := bytes.LastIndexByte(r.buf, '\n')
+	if i == -1 {
+		return len(p), nil
+	}
+
+	lines := r.redact(string(r.buf[:i+1]))
+	r.buf = r.buf[i+1:]
+
+	if _, err := io.WriteString(r.w, lines); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out any incomplete line left in the buffer.
+func (r *redactor) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.buf) == 0 {
+		return nil
+	}
+
+	rest := r.redact(string(r.buf))
+	r.buf = nil
+
+	_, err := io.WriteString(r.w, rest)
+	return err
+}
+
+func (r *redactor) redact(s string) string {
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redactedText)
+	}
+	s = tokenPattern.ReplaceAllString(s, redactedText)
+	s = authorizationPattern.ReplaceAllString(s, "${1}"+redactedText)
+	return s
+}
+
+// child returns a new redactor writing to w, masking the same secrets.
+func (r *redactor) child(w io.Writer) *redactor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return &redactor{w: w, secrets: append([]string(nil), r.secrets...)}
+}
+
+// redactLog makes sure all output of h.Log goes through a redactor, and registers the given secrets with it.
+func (h *Hook) redactLog(secrets ...string) *redactor {
+	r, ok := h.Log.Output().(*redactor)
+	if !ok {
+		r = newRedactor(h.Log.Output())
+		h.Log = libbuildpack.NewLogger(r)
+	}
+	r.addSecrets(secrets...)
+	return r
+}
+
+// secrets returns all values from the credentials which must never be logged.
+func (c *credentials) secrets() []string {
+	secrets := []string{c.APIToken}
+
+	// Custom OneAgent URLs may carry credentials for the mirror, proxy URLs for the proxy.
+	for _, rawURL := range []string{c.CustomOneAgentURL, c.Proxy, c.DownloadProxy} {
+		if u, err := url.Parse(rawURL); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				secrets = append(secrets, password)
+			}
+		}
+	}
+
+	if c.ClientKey != "" {
+		secrets = append(secrets, pemSecrets(c.ClientKey)...)
+	}
+
+	return secrets
+}
@@ -0,0 +1,76 @@
+package dynatrace
+
+import "strings"
+
+// releaseVariable is one of the DT_RELEASE_* variables used by Dynatrace release analysis.
+type releaseVariable struct {
+	name  string
+	value string
+}
+
+// getReleaseVariables returns the defaults for the DT_RELEASE_* variables. Values set in the credentials take
+// precedence over the ones derived from VCAP_APPLICATION. Variables without value are left out.
+//
+// These are only defaults, the profile.d scripts keep any value the app sets at runtime.
+func (h *Hook) getReleaseVariables(creds *credentials) []releaseVariable {
+	app := h.getVCAPApplication()
+
+	pick := func(values ...string) string {
+		for _, v := range values {
+			if v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	all := []releaseVariable{
+		{name: "DT_RELEASE_PRODUCT", value: pick(creds.ReleaseProduct, app.ApplicationName)},
+		{name: "DT_RELEASE_VERSION", value: pick(creds.ReleaseVersion, app.ApplicationVersion)},
+		{name: "DT_RELEASE_STAGE", value: pick(creds.ReleaseStage, app.SpaceName)},
+		{name: "DT_RELEASE_BUILD_VERSION", value: creds.ReleaseBuildVersion},
+	}
+
+	var vars []releaseVariable
+	for _, v := range all {
+		if v.value != "" {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// shellQuote escapes s for use inside a double-quoted string in a shell script.
+func shellQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(s)
+}
+
+// shellUnquote reverses shellQuote.
+func shellUnquote(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\$`, "$", "\\`", "`").Replace(s)
+}
+
+// cmdQuote escapes s for use inside a quoted 'set "name=value"' command in a .cmd script.
+func cmdQuote(s string) string {
+	return cmdEscape(s, true)
+}
+
+// cmdEscape escapes s for a command in a .cmd script, starting inside double quotes if quoted is set. Percent signs are
+// doubled so that they aren't expanded. Double quotes in s toggle the quoting, and special characters outside of quotes
+// are escaped with a caret. Inside quotes, cmd would keep the caret.
+func cmdEscape(s string, quoted bool) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '%':
+			sb.WriteString("%%")
+			continue
+		case r == '"':
+			quoted = !quoted
+		case !quoted && strings.ContainsRune("^&|<>()", r):
+			sb.WriteRune('^')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
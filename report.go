@@ -0,0 +1,180 @@
+package dynatrace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stagingReportFilename is the name of the report written into the OneAgent install directory.
+const stagingReportFilename = "staging-report.json"
+
+// stagingReport describes what the hook did during staging. It's written as JSON into the droplet, so that platform
+// teams can audit what was installed. It must never contain secrets.
+//
+// All methods can be called on a nil report, in which case nothing is recorded.
+type stagingReport struct {
+	CredentialSource  string              `json:"credentialSource"`
+	ServiceName       string              `json:"serviceName"`
+	EnvironmentID     string              `json:"environmentId,omitempty"`
+	APIURL            string              `json:"apiUrl,omitempty"`
+	DownloadURL       string              `json:"downloadUrl,omitempty"`
+	AgentVersion      string              `json:"agentVersion,omitempty"`
+	AgentLibrary      string              `json:"agentLibrary,omitempty"`
+	Technologies      []string            `json:"technologies"`
+	NetworkZone       string              `json:"networkZone,omitempty"`
+	ConfigMerged      bool                `json:"configApiMerged"`
+	FIPSEnabled       bool                `json:"fipsEnabled"`
+	Environment       []stagingReportEnv  `json:"environment"`
+	Phases            []stagingReportStep `json:"phases"`
+	SkippedErrors     []string            `json:"skippedErrors,omitempty"`
+	InstallationState string              `json:"installationState"`
+}
+
+type stagingReportEnv struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type stagingReportStep struct {
+	Name       string  `json:"name"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+func newStagingReport(creds *credentials, technologies []string) *stagingReport {
+	r := &stagingReport{
+		CredentialSource:  creds.Source,
+		ServiceName:       creds.ServiceName,
+		EnvironmentID:     creds.EnvironmentID,
+		APIURL:            redactURL(creds.APIURL),
+		NetworkZone:       creds.NetworkZone,
+		Technologies:      append([]string(nil), technologies...),
+		Environment:       []stagingReportEnv{},
+		Phases:            []stagingReportStep{},
+		InstallationState: "failed",
+	}
+	if creds.AddTechnologies != "" {
+		r.Technologies = append(r.Technologies, strings.Split(creds.AddTechnologies, ",")...)
+	}
+	return r
+}
+
+// startPhase starts measuring a phase of the staging. The returned function stops it.
+func (r *stagingReport) startPhase(name string) func() {
+	start := time.Now()
+	return func() {
+		if r != nil {
+			r.Phases = append(r.Phases, stagingReportStep{Name: name, DurationMs: float64(time.Since(start).Microseconds()) / 1000})
+		}
+	}
+}
+
+// skip records an error that was skipped because of the skiperrors setting.
+func (r *stagingReport) skip(step string, err error) {
+	if r != nil {
+		r.SkippedErrors = append(r.SkippedErrors, fmt.Sprintf("%s: %s", step, err))
+	}
+}
+
+// addEnv records an environment variable set up for the app at runtime.
+func (r *stagingReport) addEnv(name, value string) {
+	if r != nil {
+		r.Environment = append(r.Environment, stagingReportEnv{Name: name, Value: value})
+	}
+}
+
+// setConfigMerged records whether the config from the API was merged into the agent's config.
+func (r *stagingReport) setConfigMerged(merged bool) {
+	if r != nil {
+		r.ConfigMerged = merged
+	}
+}
+
+// writeStagingReport writes the report into dir. Failures are only logged, since the report is not essential.
+func (h *Hook) writeStagingReport(report *stagingReport, dir string) {
+	if report.AgentVersion == "" {
+		report.AgentVersion = readManifestVersion(dir)
+	}
+
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(dir, 0755); err == nil {
+			err = os.WriteFile(filepath.Join(dir, stagingReportFilename), append(raw, '\n'), 0644)
+		}
+	}
+
+	if err != nil {
+		h.Log.Warning("Failed to write staging report: %s", err)
+		return
+	}
+	h.Log.Debug("Wrote staging report to %s", filepath.Join(dir, stagingReportFilename))
+}
+
+// readManifestVersion returns the agent version from the manifest.json of the OneAgent package, or an empty string
+// if it can't be read.
+func readManifestVersion(installDir string) string {
+	raw, err := os.ReadFile(filepath.Join(installDir, "manifest.json"))
+	if err != nil {
+		return ""
+	}
+
+	var manifest struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return ""
+	}
+	return manifest.Version
+}
+
+// redactURL removes the password and query parameters, which may carry tokens, from a URL.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactedText
+	}
+
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedText)
+		}
+	}
+
+	query := u.Query()
+	for key := range query {
+		if !isPublicQueryParameter(key) {
+			query.Set(key, redactedText)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// redactURLError redacts the URL in err, if it's a *url.Error, so that a URL failing to parse doesn't end up in the
+// log with its credentials.
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return &url.Error{Op: urlErr.Op, URL: redactURL(urlErr.URL), Err: urlErr.Err}
+	}
+	return err
+}
+
+// isPublicQueryParameter returns true for the parameters we set ourselves on deployment API requests.
+func isPublicQueryParameter(key string) bool {
+	switch key {
+	case "bitness", "arch", "flavor", "include", "networkZone":
+		return true
+	}
+	return false
+}
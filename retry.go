@@ -0,0 +1,209 @@
+package dynatrace
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxRetryDuration limits the time spent on a request against the tenant, including all of its retries.
+	defaultMaxRetryDuration = 5 * time.Minute
+
+	// defaultRetryBaseDelay is the delay before the first retry, it's doubled for every further one.
+	defaultRetryBaseDelay = time.Second
+
+	// maxRetryDelay caps the exponential backoff.
+	maxRetryDelay = 30 * time.Second
+)
+
+// statusError is returned for requests the API answered with an error status.
+type statusError struct {
+	status     string
+	statusCode int
+
+	// retryAfter is the delay the server asked for through the Retry-After header, if any.
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return "API returned with status " + e.status
+}
+
+// permanentError marks errors which retrying can't resolve.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent wraps err so that the request isn't retried.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// checkResponse returns a statusError if the API answered with an error status.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+	return &statusError{
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter parses the Retry-After header, which holds either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+
+	return 0
+}
+
+// isRetryable returns true if a request failing with err may succeed if sent again. Client errors are permanent,
+// except for timeouts and rate limiting.
+func isRetryable(err error) bool {
+	var perm *permanentError
+	if errors.As(err, &perm) {
+		return false
+	}
+
+	var status *statusError
+	if errors.As(err, &status) {
+		switch {
+		case status.statusCode == http.StatusRequestTimeout, status.statusCode == http.StatusTooManyRequests:
+			return true
+		case status.statusCode == http.StatusNotImplemented, status.statusCode == http.StatusHTTPVersionNotSupported:
+			return false
+		default:
+			return status.statusCode >= 500
+		}
+	}
+
+	// Everything else are connection problems or failures while reading the response.
+	return true
+}
+
+// retryRand randomizes the retry delays. The global source of math/rand is only seeded automatically as of Go 1.20,
+// before that all stagings would wait the same times.
+var retryRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+
+// lockedSource makes a rand.Source safe for concurrent use, e.g. by the download started in BeforeCompile.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// retryDelay returns how long to wait before the given retry, starting with 0: the base delay doubled for every
+// retry, capped and randomized by up to half of it, so that many stagings failing at once don't retry in lockstep.
+func retryDelay(base time.Duration, retry int) time.Duration {
+	delay := maxRetryDelay
+	if retry < 16 && base<<uint(retry) < maxRetryDelay {
+		delay = base << uint(retry)
+	}
+
+	half := delay / 2
+	return half + time.Duration(retryRand.Int63n(int64(half)+1))
+}
+
+// withRetries calls attempt until it succeeds, fails with an error which can't be resolved by retrying, or the
+// retries are exhausted. description names what's attempted in the log, e.g. "installer download". All requests
+// against the tenant and the OneAgent mirror go through here, except for best-effort ones which are only sent once.
+// The number of retries is limited by MaxDownloadRetries, the total time spent by MaxRetryDuration and ctx.
+func (h *Hook) withRetries(ctx context.Context, description string, attempt func() error) error {
+	maxDuration := h.MaxRetryDuration
+	if maxDuration == 0 {
+		maxDuration = defaultMaxRetryDuration
+	}
+	baseDelay := h.RetryBaseDelay
+	if baseDelay == 0 {
+		baseDelay = defaultRetryBaseDelay
+	}
+
+	deadline := time.Now().Add(maxDuration)
+
+	for i := 0; ; i++ {
+		if ctx.Err() != nil {
+			return contextError(ctx, description)
+		}
+
+		err := attempt()
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return contextError(ctx, description)
+		}
+
+		if !isRetryable(err) {
+			return err
+		}
+
+		if i >= h.MaxDownloadRetries {
+			if h.MaxDownloadRetries > 0 {
+				h.Log.Warning("Maximum number of retries attempted: %d", h.MaxDownloadRetries)
+			}
+			return err
+		}
+
+		delay := retryDelay(baseDelay, i)
+		var status *statusError
+		if errors.As(err, &status) && status.retryAfter > 0 {
+			delay = status.retryAfter
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			h.Log.Warning("Not retrying %s, the retry time budget of %v would be exceeded", description, maxDuration)
+			return err
+		}
+		if ctxDeadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(ctxDeadline) {
+			h.Log.Warning("Not retrying %s, the timeout for setting up Dynatrace would be exceeded", description)
+			return err
+		}
+
+		h.Log.Warning("Error during %s, retrying in %v: %s", description, delay.Round(time.Millisecond), err)
+		if sleep(ctx, delay) != nil {
+			return contextError(ctx, description)
+		}
+	}
+}
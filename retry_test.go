@@ -0,0 +1,130 @@
+package dynatrace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("withRetries", func() {
+	var (
+		hook     *Hook
+		buffer   *bytes.Buffer
+		attempts int
+	)
+
+	failWith := func(errs ...error) func() error {
+		return func() error {
+			attempts++
+			if attempts <= len(errs) {
+				return errs[attempts-1]
+			}
+			return nil
+		}
+	}
+
+	BeforeEach(func() {
+		buffer = new(bytes.Buffer)
+		hook = &Hook{
+			Log:                libbuildpack.NewLogger(buffer),
+			MaxDownloadRetries: 3,
+			RetryBaseDelay:     time.Millisecond,
+		}
+		attempts = 0
+	})
+
+	It("retries server errors and connection problems", func() {
+		err := hook.withRetries(context.Background(), "test request", failWith(&statusError{status: "503", statusCode: 503}, errors.New("connection reset")))
+
+		Expect(err).To(BeNil())
+		Expect(attempts).To(Equal(3))
+		Expect(buffer.String()).To(ContainSubstring("Error during test request, retrying in"))
+	})
+
+	It("fails fast on permanent errors", func() {
+		for _, code := range []int{400, 401, 403, 404} {
+			attempts = 0
+			err := hook.withRetries(context.Background(), "test request", failWith(&statusError{status: "4xx", statusCode: code}))
+
+			Expect(err).NotTo(BeNil())
+			Expect(attempts).To(Equal(1))
+		}
+
+		attempts = 0
+		Expect(hook.withRetries(context.Background(), "test request", failWith(permanent(errors.New("disk full"))))).NotTo(Succeed())
+		Expect(attempts).To(Equal(1))
+	})
+
+	It("gives up after the maximum number of retries", func() {
+		hook.MaxDownloadRetries = 2
+		err := hook.withRetries(context.Background(), "test request", failWith(errors.New("a"), errors.New("b"), errors.New("c"), errors.New("d")))
+
+		Expect(err).To(MatchError("c"))
+		Expect(attempts).To(Equal(3))
+		Expect(buffer.String()).To(ContainSubstring("Maximum number of retries attempted: 2"))
+	})
+
+	It("honors Retry-After", func() {
+		start := time.Now()
+		err := hook.withRetries(context.Background(), "test request", failWith(&statusError{status: "429", statusCode: 429, retryAfter: 50 * time.Millisecond}))
+
+		Expect(err).To(BeNil())
+		Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		Expect(buffer.String()).To(ContainSubstring("retrying in 50ms"))
+	})
+
+	It("doesn't retry beyond the time budget", func() {
+		hook.MaxRetryDuration = time.Second
+		err := hook.withRetries(context.Background(), "test request", failWith(&statusError{status: "503", statusCode: 503, retryAfter: time.Minute}))
+
+		Expect(err).NotTo(BeNil())
+		Expect(attempts).To(Equal(1))
+		Expect(buffer.String()).To(ContainSubstring("Not retrying test request, the retry time budget of 1s would be exceeded"))
+	})
+})
+
+var _ = Describe("retryDelay", func() {
+	It("doubles the delay and adds jitter", func() {
+		for i := 0; i < 100; i++ {
+			Expect(retryDelay(time.Second, 0)).To(BeNumerically("~", 750*time.Millisecond, 250*time.Millisecond))
+			Expect(retryDelay(time.Second, 2)).To(BeNumerically("~", 3*time.Second, time.Second))
+			Expect(retryDelay(time.Second, 20)).To(BeNumerically("~", 22500*time.Millisecond, 7500*time.Millisecond))
+		}
+	})
+})
+
+var _ = Describe("retryRand", func() {
+	It("isn't the unseeded global source", func() {
+		unseeded := rand.New(rand.NewSource(1))
+		same := 0
+		for i := 0; i < 10; i++ {
+			if retryRand.Int63() == unseeded.Int63() {
+				same++
+			}
+		}
+		Expect(same).To(BeNumerically("<", 10))
+	})
+})
+
+var _ = Describe("parseRetryAfter", func() {
+	now := time.Date(2023, 10, 12, 12, 0, 0, 0, time.UTC)
+
+	It("parses seconds and HTTP dates", func() {
+		Expect(parseRetryAfter("120", now)).To(Equal(2 * time.Minute))
+		Expect(parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now)).To(Equal(30 * time.Second))
+	})
+
+	It("ignores invalid and past values", func() {
+		Expect(parseRetryAfter("", now)).To(BeZero())
+		Expect(parseRetryAfter("-1", now)).To(BeZero())
+		Expect(parseRetryAfter("soon", now)).To(BeZero())
+		Expect(parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now)).To(BeZero())
+	})
+})
@@ -0,0 +1,144 @@
+package dynatrace_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"time"
+)
+
+// signInstaller appends a CMS signature over script to it, in the same way Dynatrace signs paas-sh installers. It
+// returns the signed installer and the PEM-encoded root certificate the signature can be verified with.
+func signInstaller(script string) (string, string) {
+	type attribute struct {
+		Type   asn1.ObjectIdentifier
+		Values []asn1.RawValue `asn1:"set"`
+	}
+
+	type issuerAndSerial struct {
+		Issuer asn1.RawValue
+		Serial *big.Int
+	}
+
+	type signerInfo struct {
+		Version            int
+		SID                issuerAndSerial
+		DigestAlgorithm    pkix.AlgorithmIdentifier
+		SignedAttrs        asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          []byte
+	}
+
+	type encapContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+	}
+
+	type signedData struct {
+		Version          int
+		DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+		EncapContentInfo encapContentInfo
+		Certificates     asn1.RawValue
+		SignerInfos      []signerInfo `asn1:"set"`
+	}
+
+	type contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}
+
+	var (
+		oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+		oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+		oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+		oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+		oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+		oidRSA           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	)
+
+	must := func(err error) {
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	must(err)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	must(err)
+	root, err := x509.ParseCertificate(rootDER)
+	must(err)
+
+	signerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	must(err)
+	signerTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	signerDER, err := x509.CreateCertificate(rand.Reader, signerTemplate, root, &signerKey.PublicKey, rootKey)
+	must(err)
+	signer, err := x509.ParseCertificate(signerDER)
+	must(err)
+
+	contentTypeValue, err := asn1.Marshal(oidData)
+	must(err)
+	contentDigest := sha256.Sum256([]byte(script))
+	messageDigestValue, err := asn1.Marshal(contentDigest[:])
+	must(err)
+
+	attrs, err := asn1.MarshalWithParams([]attribute{
+		{Type: oidContentType, Values: []asn1.RawValue{{FullBytes: contentTypeValue}}},
+		{Type: oidMessageDigest, Values: []asn1.RawValue{{FullBytes: messageDigestValue}}},
+	}, "set")
+	must(err)
+
+	attrsDigest := sha256.Sum256(attrs)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signerKey, crypto.SHA256, attrsDigest[:])
+	must(err)
+
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: encapContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signer.Raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerial{Issuer: asn1.RawValue{FullBytes: signer.RawIssuer}, Serial: signer.SerialNumber},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{FullBytes: append([]byte{0xa0}, attrs[1:]...)},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSA},
+			Signature:          signature,
+		}},
+	})
+	must(err)
+
+	ci, err := asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd}})
+	must(err)
+
+	installer := script + "\n----SIGNED-INSTALLER\n" +
+		"Content-Type: application/x-pkcs7-signature; name=\"smime.p7s\"\n" +
+		"Content-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString(ci) + "\n\n" +
+		"----SIGNED-INSTALLER--\n"
+
+	return installer, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER}))
+}
@@ -0,0 +1,110 @@
+package dynatrace
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// Stager describes the app being staged and where the hook installs the agent to. *libbuildpack.Stager implements
+// it, DirStager can be used to run the hook outside of classic buildpacks.
+type Stager interface {
+	// BuildDir is the directory holding the app.
+	BuildDir() string
+
+	// DepDir is the directory of the buildpack's dependencies, profile.d scripts are written below it.
+	DepDir() string
+
+	// CacheDir persists between stagings, it may be empty if there's no cache.
+	CacheDir() string
+
+	// BuildpackLanguage and BuildpackVersion describe the buildpack running the hook. They're added to the custom
+	// properties of the monitored processes and to the User-Agent of requests against the tenant.
+	BuildpackLanguage() string
+	BuildpackVersion() (string, error)
+
+	// WriteProfileD writes a script which is run when the app's container starts.
+	WriteProfileD(scriptName, scriptContents string) error
+}
+
+var _ Stager = (*libbuildpack.Stager)(nil)
+
+// installDirStager is implemented by stagers which have the agent installed outside of the app, like DirStager.
+type installDirStager interface {
+	// InstallDir is the directory the agent is installed below, into dynatrace/oneagent.
+	InstallDir() string
+}
+
+// installRoot returns the directory the agent is installed below. Unless the stager says otherwise, that's the app
+// directory.
+func installRoot(stager Stager) string {
+	if s, ok := stager.(installDirStager); ok && s.InstallDir() != "" {
+		return s.InstallDir()
+	}
+	return stager.BuildDir()
+}
+
+// DirStager is a Stager for the given directories, e.g. to run the hook from a CLI or a Cloud Native Buildpack.
+type DirStager struct {
+	// App, Deps and Cache are the directories returned by BuildDir, DepDir and CacheDir. The app directory is only
+	// read, e.g. to detect binaries linked against musl libc.
+	App   string
+	Deps  string
+	Cache string
+
+	// Install is the directory the agent is installed below. If empty, it's installed into the app directory.
+	Install string
+
+	// Profile is the directory WriteProfileD writes scripts to. If empty, it's the profile.d directory below Deps.
+	Profile string
+
+	// Language and Version describe the buildpack running the hook.
+	Language string
+	Version  string
+}
+
+// BuildDir returns the app directory.
+func (s *DirStager) BuildDir() string {
+	return s.App
+}
+
+// InstallDir returns the directory the agent is installed below.
+func (s *DirStager) InstallDir() string {
+	if s.Install != "" {
+		return s.Install
+	}
+	return s.App
+}
+
+// DepDir returns the dependencies directory.
+func (s *DirStager) DepDir() string {
+	return s.Deps
+}
+
+// CacheDir returns the cache directory, empty if there's none.
+func (s *DirStager) CacheDir() string {
+	return s.Cache
+}
+
+// BuildpackLanguage returns the language of the buildpack running the hook.
+func (s *DirStager) BuildpackLanguage() string {
+	return s.Language
+}
+
+// BuildpackVersion returns the version of the buildpack running the hook, it never fails.
+func (s *DirStager) BuildpackVersion() (string, error) {
+	return s.Version, nil
+}
+
+// WriteProfileD writes an executable script to the profile directory, creating it if needed.
+func (s *DirStager) WriteProfileD(scriptName, scriptContents string) error {
+	profileDir := s.Profile
+	if profileDir == "" {
+		profileDir = filepath.Join(s.Deps, "profile.d")
+	}
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(profileDir, scriptName), []byte(scriptContents), 0755)
+}
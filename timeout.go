@@ -0,0 +1,91 @@
+package dynatrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// stagingTimeoutEnv sets the timeout for setting up Dynatrace if the credentials don't.
+const stagingTimeoutEnv = "DT_STAGING_TIMEOUT"
+
+// getTimeout returns how long setting up Dynatrace may take, from the timeout credential, the DT_STAGING_TIMEOUT
+// environment variable or the hook's Timeout, in that order. Zero means no limit.
+func (h *Hook) getTimeout(creds *credentials) (time.Duration, error) {
+	value, name := creds.Timeout, "timeout"
+	if value == "" {
+		value, name = os.Getenv(stagingTimeoutEnv), stagingTimeoutEnv
+	}
+	if value == "" {
+		return h.Timeout, nil
+	}
+	return parseTimeout(name, value)
+}
+
+// parseTimeout parses a timeout given as a number of seconds or as a duration like '5m'.
+func parseTimeout(name, value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if seconds, atoiErr := strconv.Atoi(value); atoiErr == nil {
+		timeout, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid %s '%s', expected seconds or a duration like '5m'", name, value)
+	}
+	return timeout, nil
+}
+
+// contextError describes why ctx is done, for an operation it stopped. Retrying doesn't help with these.
+func contextError(ctx context.Context, what string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return permanent(fmt.Errorf("%s exceeded the timeout for setting up Dynatrace: %w", what, ctx.Err()))
+	}
+	return permanent(fmt.Errorf("%s cancelled: %w", what, ctx.Err()))
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// executeCommand runs program through h.Command until it finishes or ctx is done. Processes started by
+// *libbuildpack.Command are killed then, other Commands can't be stopped and are left running in the background.
+func (h *Hook) executeCommand(ctx context.Context, what string, stdout, stderr io.Writer, program string, args ...string) error {
+	if command, ok := h.Command.(*libbuildpack.Command); ok {
+		cmd := exec.CommandContext(ctx, program, args...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		err := command.Run(cmd)
+		if ctx.Err() != nil {
+			return contextError(ctx, what)
+		}
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Command.Execute("", stdout, stderr, program, args...)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return contextError(ctx, what)
+	}
+}
@@ -0,0 +1,45 @@
+package dynatrace
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("executeCommand", func() {
+	It("kills the process once ctx is done", func() {
+		sleepPath, err := exec.LookPath("sleep")
+		if err != nil {
+			Skip("sleep is not available")
+		}
+
+		hook := &Hook{Command: &libbuildpack.Command{}}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err = hook.executeCommand(ctx, "installer", io.Discard, io.Discard, sleepPath, "10")
+
+		Expect(err).To(MatchError("installer exceeded the timeout for setting up Dynatrace: context deadline exceeded"))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+})
+
+var _ = Describe("parseTimeout", func() {
+	It("accepts seconds and durations", func() {
+		Expect(parseTimeout("timeout", "90")).To(Equal(90 * time.Second))
+		Expect(parseTimeout("timeout", "5m")).To(Equal(5 * time.Minute))
+	})
+
+	It("rejects anything else", func() {
+		for _, value := range []string{"soon", "-1", "-5m", "5 minutes"} {
+			_, err := parseTimeout("timeout", value)
+			Expect(err).NotTo(BeNil())
+		}
+	})
+})
@@ -0,0 +1,113 @@
+package dynatrace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// agentCustomKeysPath is where OneAgent looks for additional certificates to trust, relative to its install dir.
+const agentCustomKeysPath = "agent/customkeys/custom.pem"
+
+// decodePEMSetting returns the PEM data of a cacert, clientcert or clientkey setting, which hold PEM either inline or
+// base64-encoded.
+func decodePEMSetting(name, value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	if err != nil || !strings.Contains(string(decoded), "-----BEGIN") {
+		return nil, fmt.Errorf("%s is neither PEM nor base64-encoded PEM", name)
+	}
+	return decoded, nil
+}
+
+// setUpTLS prepares the TLS settings for all requests against the tenant and the OneAgent mirror, if the credentials
+// configure a CA bundle or a client certificate. Otherwise, the system trust store is used.
+func (h *Hook) setUpTLS(creds *credentials) error {
+	if creds.CACert == "" && creds.ClientCert == "" && creds.ClientKey == "" {
+		return nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if creds.CACert != "" {
+		caCert, err := decodePEMSetting("cacert", creds.CACert)
+		if err != nil {
+			return err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			h.Log.Debug("Failed to load system certificates, only trusting cacert: %s", err)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCert) {
+			return errors.New("cacert holds no valid certificate")
+		}
+		config.RootCAs = pool
+	}
+
+	if creds.ClientCert != "" || creds.ClientKey != "" {
+		if creds.ClientCert == "" || creds.ClientKey == "" {
+			return errors.New("clientcert and clientkey have to be configured together")
+		}
+
+		clientCert, err := decodePEMSetting("clientcert", creds.ClientCert)
+		if err != nil {
+			return err
+		}
+		clientKey, err := decodePEMSetting("clientkey", creds.ClientKey)
+		if err != nil {
+			return err
+		}
+
+		cert, err := tls.X509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	h.Log.Debug("Using custom TLS settings for requests to the tenant (cacert: %t, client certificate: %t)",
+		creds.CACert != "", len(config.Certificates) > 0)
+	creds.tlsConfig = config
+	return nil
+}
+
+// installCACert writes the cacert into the custom keys of OneAgent, so that the agent trusts the same CA at runtime.
+func (h *Hook) installCACert(creds *credentials, installDir string) error {
+	caCert, err := decodePEMSetting("cacert", creds.CACert)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(installDir, filepath.FromSlash(agentCustomKeysPath))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	h.Log.Debug("Writing cacert to %s", path)
+	return os.WriteFile(path, caCert, 0644)
+}
+
+// pemSecrets returns the lines of a PEM setting which must never be logged, as well as the setting itself.
+func pemSecrets(value string) []string {
+	secrets := []string{value}
+
+	if decoded, err := decodePEMSetting("", value); err == nil {
+		for _, line := range strings.Split(string(decoded), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "-----") {
+				secrets = append(secrets, line)
+			}
+		}
+	}
+
+	return secrets
+}
@@ -1,6 +1,7 @@
 package dynatrace
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -9,21 +10,19 @@ import (
 	"github.com/cloudfoundry/libbuildpack"
 )
 
-func (h *Hook) runInstallerUnix(installerFilePath, installDir string, creds *credentials, stager *libbuildpack.Stager) error {
-	h.Log.Debug("Making %s executable...", installerFilePath)
-	err := os.Chmod(installerFilePath, 0755)
-	if err != nil {
-		h.Log.Error("Error while setting installer file %s executable", installerFilePath)
-		return err
-	}
-
-
+func (h *Hook) runInstallerUnix(ctx context.Context, installerFilePath, installDir string, creds *credentials, stager Stager, report *stagingReport) error {
 	h.Log.BeginStep("Starting Dynatrace OneAgent installer")
 
-	if os.Getenv("BP_DEBUG") != "" {
-		err = h.Command.Execute("", os.Stdout, os.Stderr, installerFilePath, stager.BuildDir())
-	} else {
-		err = h.Command.Execute("", io.Discard, io.Discard, installerFilePath, stager.BuildDir())
+	// We unpack the installer ourselves if we understand its format, so that no shell and tools are needed in the
+	// staging container. Otherwise, the installer script does it.
+	installer, err := openPaaSInstaller(installerFilePath)
+	if err == nil {
+		h.Log.Debug("Extracting %s...", installerFilePath)
+		maxSize, maxFiles := h.extractLimits()
+		err = installer.extract(ctx, filepath.Join(installRoot(stager), installDir), maxSize, maxFiles)
+	} else if err == errUnknownInstallerFormat {
+		h.Log.Debug("Installer format not recognized, running the installer")
+		err = h.executeInstallerUnix(ctx, installerFilePath, stager)
 	}
 	if err != nil {
 		return err
@@ -35,14 +34,14 @@ func (h *Hook) runInstallerUnix(installerFilePath, installDir string, creds *cre
 
 	dynatraceEnvName := "dynatrace-env.sh"
 	dynatraceEnvPath := filepath.Join(stager.DepDir(), "profile.d", dynatraceEnvName)
-	agentLibPath, err := h.findAgentPath(filepath.Join(stager.BuildDir(), installDir), "process", "primary", "liboneagentproc.so", "linux-x86-64")
+	agentLibPath, err := h.findAgentPath(filepath.Join(installRoot(stager), installDir), "process", "primary", "liboneagentproc.so", h.getPlatformName("linux", h.usesMusl(creds, stager.BuildDir())))
 	if err != nil {
 		h.Log.Error("Manifest handling failed!")
 		return err
 	}
 
 	agentLibPath = filepath.Join(installDir, agentLibPath)
-	agentBuilderLibPath := filepath.Join(stager.BuildDir(), agentLibPath)
+	agentBuilderLibPath := filepath.Join(installRoot(stager), agentLibPath)
 
 	if _, err = os.Stat(agentBuilderLibPath); os.IsNotExist(err) {
 		h.Log.Error("Agent library (%s) not found!", agentBuilderLibPath)
@@ -51,7 +50,7 @@ func (h *Hook) runInstallerUnix(installerFilePath, installDir string, creds *cre
 
 	h.Log.BeginStep("Setting up Dynatrace OneAgent injection...")
 	h.Log.Debug("Copy %s to %s", dynatraceEnvName, dynatraceEnvPath)
-	if err = libbuildpack.CopyFile(filepath.Join(stager.BuildDir(), installDir, dynatraceEnvName), dynatraceEnvPath); err != nil {
+	if err = libbuildpack.CopyFile(filepath.Join(installRoot(stager), installDir, dynatraceEnvName), dynatraceEnvPath); err != nil {
 		return err
 	}
 
@@ -66,11 +65,14 @@ func (h *Hook) runInstallerUnix(installerFilePath, installDir string, creds *cre
 	extra := ""
 
 	h.Log.Debug("Setting LD_PRELOAD...")
-	extra += fmt.Sprintf("\nexport LD_PRELOAD=${HOME}/%s", agentLibPath)
+	extra += fmt.Sprintf("\nexport LD_PRELOAD=${HOME}/%s", filepath.ToSlash(agentLibPath))
+	report.addEnv("LD_PRELOAD", "${HOME}/"+filepath.ToSlash(agentLibPath))
+	report.AgentLibrary = filepath.ToSlash(agentLibPath)
 
 	if creds.NetworkZone != "" {
 		h.Log.Debug("Setting DT_NETWORK_ZONE...")
 		extra += fmt.Sprintf("\nexport DT_NETWORK_ZONE=${DT_NETWORK_ZONE:-%s}", creds.NetworkZone)
+		report.addEnv("DT_NETWORK_ZONE", creds.NetworkZone)
 	}
 
 	// By default, OneAgent logs are printed to stderr. If the customer doesn't override this behavior through an
@@ -78,6 +80,13 @@ func (h *Hook) runInstallerUnix(installerFilePath, installDir string, creds *cre
 	if os.Getenv("DT_LOGSTREAM") == "" {
 		h.Log.Debug("Setting DT_LOGSTREAM to stdout...")
 		extra += "\nexport DT_LOGSTREAM=stdout"
+		report.addEnv("DT_LOGSTREAM", "stdout")
+	}
+
+	h.Log.Debug("Setting release variables...")
+	for _, v := range h.getReleaseVariables(creds) {
+		extra += fmt.Sprintf("\nexport %s=\"${%s:-%s}\"", v.name, v.name, shellQuote(v.value))
+		report.addEnv(v.name, v.value)
 	}
 
 	ver, err := stager.BuildpackVersion()
@@ -88,6 +97,7 @@ func (h *Hook) runInstallerUnix(installerFilePath, installDir string, creds *cre
 	h.Log.Debug("Preparing custom properties...")
 	extra += fmt.Sprintf(
 		"\nexport DT_CUSTOM_PROP=\"${DT_CUSTOM_PROP} CloudFoundryBuildpackLanguage=%s CloudFoundryBuildpackVersion=%s\"", stager.BuildpackLanguage(), ver)
+	report.addEnv("DT_CUSTOM_PROP", fmt.Sprintf("CloudFoundryBuildpackLanguage=%s CloudFoundryBuildpackVersion=%s", stager.BuildpackLanguage(), ver))
 
 	if _, err = f.WriteString(extra); err != nil {
 		return err
@@ -95,3 +105,24 @@ func (h *Hook) runInstallerUnix(installerFilePath, installDir string, creds *cre
 
 	return nil
 }
+
+func (h *Hook) executeInstallerUnix(ctx context.Context, installerFilePath string, stager Stager) error {
+	h.Log.Debug("Making %s executable...", installerFilePath)
+	err := os.Chmod(installerFilePath, 0755)
+	if err != nil {
+		h.Log.Error("Error while setting installer file %s executable", installerFilePath)
+		return err
+	}
+
+	if os.Getenv("BP_DEBUG") != "" {
+		// The installer output may contain secrets, so it goes through the same redaction as our log.
+		logRedactor := h.redactLog()
+		stderr := logRedactor.child(os.Stderr)
+		err = h.executeCommand(ctx, "installer", logRedactor, stderr, installerFilePath, installRoot(stager))
+		logRedactor.Flush()
+		stderr.Flush()
+	} else {
+		err = h.executeCommand(ctx, "installer", io.Discard, io.Discard, installerFilePath, installRoot(stager))
+	}
+	return err
+}
@@ -0,0 +1,367 @@
+package dynatrace
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// signatureBoundary separates the installer script from the S/MIME signature Dynatrace appends to paas-sh installers.
+const signatureBoundary = "----SIGNED-INSTALLER"
+
+// maxSignatureSize is how much of the end of an installer is searched for the signature.
+const maxSignatureSize = 64 * 1024
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// With these types, we replicate the parts of the CMS structure (RFC 5652) we need to verify a detached signature.
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo asn1.RawValue
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// verifyInstaller checks the installer against the checksum configured in the credentials and, for paas-sh installers,
+// verifies their signature against the trusted root certificates. Without a root certificate, paas-sh installers are
+// rejected unless signature verification was explicitly skipped. The installer must not be run if an error is returned.
+func (h *Hook) verifyInstaller(installerFilePath string, creds *credentials) error {
+	if creds.InstallerChecksum != "" {
+		h.Log.Debug("Verifying installer checksum...")
+		if err := verifyChecksum(installerFilePath, creds.InstallerChecksum); err != nil {
+			return err
+		}
+		h.Log.Info("Installer checksum verified.")
+	}
+
+	if !strings.HasSuffix(installerFilePath, ".sh") {
+		return nil
+	}
+
+	// A root certificate given through the credentials is always verified against.
+	rootCerts := h.InstallerCertificates
+	if creds.InstallerCertificate != "" {
+		rootCerts = []byte(creds.InstallerCertificate)
+	} else if h.SkipSignatureVerification || creds.SkipSignatureVerification {
+		h.Log.Warning("Skipping installer signature verification")
+		return nil
+	}
+
+	if len(rootCerts) == 0 {
+		h.Log.Debug("No root certificate configured, not verifying the installer signature")
+		return nil
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootCerts) {
+		return errors.New("failed to parse root certificate for installer verification")
+	}
+
+	f, err := os.Open(installerFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	content, signature, err := splitSignedInstaller(f)
+	if err != nil {
+		return err
+	} else if content == nil {
+		return errors.New("installer is not signed")
+	}
+
+	h.Log.Debug("Verifying installer signature...")
+	if err := verifyDetachedSignature(content, signature, roots); err != nil {
+		return fmt.Errorf("installer signature verification failed: %s", err)
+	}
+	h.Log.Info("Installer signature verified.")
+
+	return nil
+}
+
+// verifyChecksum compares the SHA-256 checksum of the file with the expected hex-encoded one.
+func verifyChecksum(filePath, expected string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(actual, strings.TrimSpace(expected)) {
+		return fmt.Errorf("installer checksum mismatch: expected %s, got %s", expected, actual)
+	}
+
+	return nil
+}
+
+// splitSignedInstaller separates the installer into the signed content and the DER-encoded signature. The signature
+// is attached as the second part of a multipart/signed S/MIME message, whose boundary follows the script. Only the
+// end of the file is read, the content is returned as a section of f. It's nil if the installer isn't signed.
+func splitSignedInstaller(f *os.File) (content *io.SectionReader, signature []byte, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tailOffset := info.Size() - maxSignatureSize
+	if tailOffset < 0 {
+		tailOffset = 0
+	}
+	tail := make([]byte, info.Size()-tailOffset)
+	if _, err := f.ReadAt(tail, tailOffset); err != nil {
+		return nil, nil, err
+	}
+
+	// The signature is appended to the script, so we look for the last boundary.
+	delimiter := []byte("\n" + signatureBoundary + "\n")
+	start := bytes.LastIndex(tail, delimiter)
+	if start == -1 {
+		delimiter = []byte("\r\n" + signatureBoundary + "\r\n")
+		if start = bytes.LastIndex(tail, delimiter); start == -1 {
+			return nil, nil, nil
+		}
+	}
+
+	part := tail[start+len(delimiter):]
+	if end := bytes.Index(part, []byte(signatureBoundary)); end != -1 {
+		part = part[:end]
+	}
+
+	// Skip the MIME headers of the signature part.
+	part = bytes.ReplaceAll(part, []byte("\r\n"), []byte("\n"))
+	if i := bytes.Index(part, []byte("\n\n")); i != -1 {
+		part = part[i+2:]
+	}
+
+	signature, err = base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(part), nil)))
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	return io.NewSectionReader(f, 0, tailOffset+int64(start)), signature, nil
+}
+
+// verifyDetachedSignature verifies a CMS signature over content, made by a code signing certificate chaining up to
+// roots. As with S/MIME, the signed content may have been canonicalized to CRLF line endings before signing.
+func verifyDetachedSignature(content io.ReadSeeker, signature []byte, roots *x509.CertPool) error {
+	var ci cmsContentInfo
+	if _, err := asn1.Unmarshal(signature, &ci); err != nil {
+		return err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return errors.New("signature is not CMS signed data")
+	}
+
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return err
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		intermediates.AddCert(cert)
+	}
+
+	for _, si := range sd.SignerInfos {
+		hashFunc, err := cmsHash(si.DigestAlgorithm.Algorithm)
+		if err != nil {
+			return err
+		}
+
+		if len(si.SignedAttrs.Bytes) == 0 {
+			return errors.New("signature has no signed attributes")
+		}
+
+		// The signed attributes are encoded with an implicit tag, but both parsing them and verifying the signature
+		// over them requires their DER encoding as a SET OF.
+		signed := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+
+		var attrs []cmsAttribute
+		if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+			return err
+		}
+
+		var messageDigest []byte
+		for _, attr := range attrs {
+			if attr.Type.Equal(oidMessageDigest) {
+				if _, err := asn1.Unmarshal(attr.Values.Bytes, &messageDigest); err != nil {
+					return err
+				}
+			}
+		}
+
+		digest, canonicalDigest, err := digestContent(hashFunc, content)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(digest, messageDigest) && !bytes.Equal(canonicalDigest, messageDigest) {
+			return errors.New("installer content does not match signed digest")
+		}
+
+		for _, cert := range certs {
+			algorithm, ok := signatureAlgorithm(hashFunc, cert)
+			if !ok || cert.CheckSignature(algorithm, signed, si.Signature) != nil {
+				continue
+			}
+
+			_, err := cert.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+			})
+			return err
+		}
+
+		return errors.New("no certificate in the signature matches the signer")
+	}
+
+	return errors.New("signature has no signers")
+}
+
+// cmsHash maps a digest algorithm identifier to the hash function.
+func cmsHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %s", oid)
+}
+
+// signatureAlgorithm combines the digest algorithm with the certificate's key type.
+func signatureAlgorithm(hashFunc crypto.Hash, cert *x509.Certificate) (x509.SignatureAlgorithm, bool) {
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		switch hashFunc {
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, true
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, true
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, true
+		}
+	case *ecdsa.PublicKey:
+		switch hashFunc {
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, true
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, true
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, true
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, false
+}
+
+// digestContent hashes content as-is and canonicalized to CRLF line endings, in a single pass.
+func digestContent(hashFunc crypto.Hash, content io.ReadSeeker) (digest, canonicalDigest []byte, err error) {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	h, canonical := hashFunc.New(), hashFunc.New()
+	crlf := &crlfWriter{w: canonical}
+	if _, err := io.Copy(io.MultiWriter(h, crlf), content); err != nil {
+		return nil, nil, err
+	}
+	crlf.flush()
+
+	return h.Sum(nil), canonical.Sum(nil), nil
+}
+
+// crlfWriter converts the line endings written through it to CRLF.
+type crlfWriter struct {
+	w io.Writer
+
+	// pendingCR is set if the last byte written was a CR, which is only kept if no LF follows.
+	pendingCR bool
+	buf       []byte
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	c.buf = c.buf[:0]
+	for _, b := range p {
+		if c.pendingCR {
+			c.pendingCR = false
+			if b != '\n' {
+				c.buf = append(c.buf, '\r')
+			}
+		}
+
+		switch b {
+		case '\r':
+			c.pendingCR = true
+		case '\n':
+			c.buf = append(c.buf, '\r', '\n')
+		default:
+			c.buf = append(c.buf, b)
+		}
+	}
+
+	if _, err := c.w.Write(c.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes a trailing CR.
+func (c *crlfWriter) flush() {
+	if c.pendingCR {
+		c.w.Write([]byte{'\r'})
+		c.pendingCR = false
+	}
+}
@@ -0,0 +1,22 @@
+package dynatrace
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("crlfWriter", func() {
+	It("converts line endings to CRLF across writes", func() {
+		var out bytes.Buffer
+		w := &crlfWriter{w: &out}
+
+		for _, chunk := range []string{"a\nb\r", "\nc\r", "d\r\r\n", "e\r"} {
+			w.Write([]byte(chunk))
+		}
+		w.flush()
+
+		Expect(out.String()).To(Equal("a\r\nb\r\nc\rd\r\r\ne\r"))
+	})
+})
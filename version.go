@@ -0,0 +1,220 @@
+package dynatrace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionConstraint represents a single term of an agentversion constraint, e.g. '>=1.279' or '1.281.*'.
+type versionConstraint struct {
+	operator string
+	segments []int
+
+	// prefix is set for wildcard and partial versions without operator, which match every version starting with
+	// the given segments.
+	prefix bool
+}
+
+// versionOperators are the operators allowed in agentversion constraints, longest first.
+var versionOperators = []string{">=", "<=", "!=", ">", "<", "="}
+
+// parseAgentVersionConstraint parses constraints like '1.281.*' or '>=1.279 <1.290'. All space-separated terms must
+// match for a version to satisfy the constraint. Operators may be separated from their version, as in '>= 1.279'.
+func parseAgentVersionConstraint(constraint string) ([]versionConstraint, error) {
+	var terms []versionConstraint
+
+	fields := strings.Fields(constraint)
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+
+		term := versionConstraint{operator: "="}
+		for _, op := range versionOperators {
+			if strings.HasPrefix(field, op) {
+				term.operator = op
+				field = strings.TrimPrefix(field, op)
+				break
+			}
+		}
+
+		// A lone operator applies to the next field.
+		if field == "" && i+1 < len(fields) {
+			i++
+			field = fields[i]
+		}
+		if field == "" || strings.ContainsAny(field[:1], "<>=!") {
+			return nil, fmt.Errorf("invalid agent version constraint '%s': missing version after '%s'", constraint, term.operator)
+		}
+
+		field = strings.TrimSuffix(strings.TrimSuffix(field, ".*"), ".x")
+		if field == "*" || field == "x" {
+			field = ""
+			term.prefix = true
+		} else if strings.ContainsAny(field, "*x") {
+			return nil, fmt.Errorf("invalid agent version constraint '%s': wildcards are only allowed at the end", constraint)
+		}
+
+		if field != "" {
+			segments, err := parseAgentVersion(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid agent version constraint '%s': %s", constraint, err)
+			}
+			term.segments = segments
+		}
+
+		if term.operator == "=" && len(term.segments) < 5 {
+			term.prefix = true
+		}
+
+		terms = append(terms, term)
+	}
+
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("invalid agent version constraint '%s'", constraint)
+	}
+
+	return terms, nil
+}
+
+// parseAgentVersion splits a OneAgent version like '1.281.0.20231012-123456' into its numeric segments.
+func parseAgentVersion(version string) ([]int, error) {
+	var segments []int
+	for _, s := range strings.FieldsFunc(version, func(r rune) bool { return r == '.' || r == '-' }) {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version '%s'", version)
+		}
+		segments = append(segments, n)
+	}
+	return segments, nil
+}
+
+// compareAgentVersions compares a and b segment by segment, treating missing segments as zero.
+func compareAgentVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// matches returns true if version satisfies the constraint term.
+func (c versionConstraint) matches(version []int) bool {
+	if c.prefix {
+		if len(version) < len(c.segments) {
+			return false
+		}
+		return compareAgentVersions(version[:len(c.segments)], c.segments) == 0
+	}
+
+	cmp := compareAgentVersions(version, c.segments)
+	switch c.operator {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
+
+// isExactAgentVersion returns true if version is a complete OneAgent version, which needs no resolution.
+func isExactAgentVersion(version string) bool {
+	segments, err := parseAgentVersion(version)
+	return err == nil && len(segments) == 5
+}
+
+// resolveAgentVersion returns the newest OneAgent version available on the tenant which satisfies the agentversion
+// constraint from the credentials. Exact versions are returned as-is.
+func (h *Hook) resolveAgentVersion(ctx context.Context, creds *credentials, stager Stager) (string, error) {
+	if isExactAgentVersion(creds.AgentVersion) {
+		return creds.AgentVersion, nil
+	}
+
+	constraint, err := parseAgentVersionConstraint(creds.AgentVersion)
+	if err != nil {
+		return "", err
+	}
+
+	apiURL, err := h.ensureApiURL(creds)
+	if err != nil {
+		return "", err
+	}
+
+	osType, installerType := h.getInstallerType()
+	versionsURL := fmt.Sprintf("%s/v1/deployment/installer/agent/versions/%s/%s", apiURL, osType, installerType)
+
+	h.Log.Debug("Resolving OneAgent version '%s' from %s", creds.AgentVersion, versionsURL)
+	client := h.newHTTPClient(creds, 10*time.Second)
+
+	var versions struct {
+		AvailableVersions []string `json:"availableVersions"`
+	}
+	err = h.withRetries(ctx, "OneAgent version listing", func() error {
+		req, err := h.newAPIRequest(ctx, "GET", versionsURL, nil, stager, creds)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if err := checkResponse(resp); err != nil {
+			return err
+		}
+		return json.NewDecoder(resp.Body).Decode(&versions)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list available OneAgent versions: %s", err)
+	}
+
+	var resolved string
+	var resolvedSegments []int
+	for _, v := range versions.AvailableVersions {
+		segments, err := parseAgentVersion(v)
+		if err != nil {
+			h.Log.Debug("Ignoring unexpected OneAgent version '%s'", v)
+			continue
+		}
+
+		matches := true
+		for _, term := range constraint {
+			if !term.matches(segments) {
+				matches = false
+				break
+			}
+		}
+
+		if matches && (resolved == "" || compareAgentVersions(segments, resolvedSegments) > 0) {
+			resolved, resolvedSegments = v, segments
+		}
+	}
+
+	if resolved == "" {
+		return "", fmt.Errorf("no available OneAgent version matches '%s'", creds.AgentVersion)
+	}
+
+	return resolved, nil
+}
@@ -6,15 +6,13 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
-
-	"github.com/cloudfoundry/libbuildpack"
 )
 
-func (h *Hook) runInstallerWindows(installerFilePath, installDir string, creds *credentials, stager *libbuildpack.Stager) error {
+func (h *Hook) runInstallerWindows(installerFilePath, installDir string, creds *credentials, stager Stager, report *stagingReport) error {
 	h.Log.BeginStep("Starting Dynatrace OneAgent installation")
 
-	h.Log.Info("Unzipping archive '%s' to '%s'", installerFilePath, filepath.Join(stager.BuildDir(), installDir))
-	err := libbuildpack.ExtractZip(installerFilePath, filepath.Join(stager.BuildDir(), installDir))
+	h.Log.Info("Unzipping archive '%s' to '%s'", installerFilePath, filepath.Join(installRoot(stager), installDir))
+	err := h.extractZip(installerFilePath, filepath.Join(installRoot(stager), installDir))
 	if err != nil {
 		h.Log.Error("Error during unzipping paas archive")
 		return err
@@ -26,7 +24,7 @@ func (h *Hook) runInstallerWindows(installerFilePath, installDir string, creds *
 
 	h.Log.BeginStep("Setting up Dynatrace OneAgent injection...")
 	if slices.Contains(h.IncludeTechnologies, "dotnet") {
-		err = h.setUpDotNetCorProfilerInjection(creds, installDir, stager)
+		err = h.setUpDotNetCorProfilerInjection(creds, installDir, stager, report)
 	} else {
 		h.Log.Warning("No injection method available for technology stack")
 		return nil
@@ -38,21 +36,34 @@ func (h *Hook) runInstallerWindows(installerFilePath, installDir string, creds *
 	return nil
 }
 
-func (h *Hook) setUpDotNetCorProfilerInjection(creds *credentials, installDir string, stager *libbuildpack.Stager) error {
+func (h *Hook) setUpDotNetCorProfilerInjection(creds *credentials, installDir string, stager Stager, report *stagingReport) error {
 	loaderPath, err := h.findAbsoluteLoaderPath(stager, installDir)
 	if err != nil {
 		return fmt.Errorf("cannot find oneagentloader.dll: %s", err)
 	}
 
-	scriptContent := "set COR_ENABLE_PROFILING=1\n"
-	scriptContent += "set COR_PROFILER={B7038F67-52FC-4DA2-AB02-969B3C1EDA03}\n"
-	scriptContent += "set DT_AGENTACTIVE=true\n"
-	scriptContent += "set DT_BLOCKLIST=powershell*\n"
-	scriptContent += fmt.Sprintf("set COR_PROFILER_PATH_64=%s\n", loaderPath)
+	scriptContent := ""
+	set := func(name, value string) {
+		scriptContent += fmt.Sprintf("set %s=%s\n", name, value)
+		report.addEnv(name, value)
+	}
+
+	set("COR_ENABLE_PROFILING", "1")
+	set("COR_PROFILER", "{B7038F67-52FC-4DA2-AB02-969B3C1EDA03}")
+	set("DT_AGENTACTIVE", "true")
+	set("DT_BLOCKLIST", "powershell*")
+	set("COR_PROFILER_PATH_64", loaderPath)
 
 	if creds.NetworkZone != "" {
 		h.Log.Debug("Setting DT_NETWORK_ZONE...")
-		scriptContent += "set DT_NETWORK_ZONE=" + creds.NetworkZone + "\n"
+		set("DT_NETWORK_ZONE", creds.NetworkZone)
+	}
+
+	// Values the app sets at runtime take precedence over ours.
+	h.Log.Debug("Setting release variables...")
+	for _, v := range h.getReleaseVariables(creds) {
+		scriptContent += fmt.Sprintf("if not defined %s set \"%s=%s\"\n", v.name, v.name, cmdQuote(v.value))
+		report.addEnv(v.name, v.value)
 	}
 
 	ver, err := stager.BuildpackVersion()
@@ -61,39 +72,39 @@ func (h *Hook) setUpDotNetCorProfilerInjection(creds *credentials, installDir st
 		ver = "unknown"
 	}
 	h.Log.Debug("Preparing custom properties...")
-	scriptContent += fmt.Sprintf("set DT_CUSTOM_PROP=\"%%DT_CUSTOM_PROP%% CloudFoundryBuildpackLanguage=%s CloudFoundryBuildpackVersion=%s\"\n", stager.BuildpackLanguage(), ver)
+	customProps := fmt.Sprintf("CloudFoundryBuildpackLanguage=%s CloudFoundryBuildpackVersion=%s", stager.BuildpackLanguage(), ver)
+	scriptContent += fmt.Sprintf("set DT_CUSTOM_PROP=\"%%DT_CUSTOM_PROP%% %s\"\n", customProps)
+	report.addEnv("DT_CUSTOM_PROP", customProps)
 
 	stager.WriteProfileD("dynatrace-env.cmd", scriptContent)
 
 	return nil
 }
 
-func (h *Hook) findAbsoluteLoaderPath(stager *libbuildpack.Stager, installDir string) (string, error) {
+func (h *Hook) findAbsoluteLoaderPath(stager Stager, installDir string) (string, error) {
 
 	// look for dotnet loader DLL file relative to the root of the downloaded zip archive
 	// and get the path from the manifest e.g. agent/bin/windows-x86-64/oneagentloader.dll
-	loaderDllPath, err := h.findAgentPath(filepath.Join(stager.BuildDir(), installDir), "dotnet", "loader", "oneagentloader.dll", "windows-x86-64")
+	loaderDllPath, err := h.findAgentPath(filepath.Join(installRoot(stager), installDir), "dotnet", "loader", "oneagentloader.dll", "windows-x86-64")
 	if err != nil {
 		h.Log.Error("Manifest handling failed!")
 		return "", err
 	}
 
-	// windows path separator is "\" instead of "/"
-	loaderDllPath = strings.ReplaceAll(loaderDllPath, "/", "\\")
-
 	// build the loader DLL path relative to the app directory
 	// e.g. dynatrace/oneagent/agent/bin/windows-x86-64/oneagentloader.dll
-	loaderDllPathInAppDir := filepath.Join(installDir, loaderDllPath)
+	loaderDllPathInAppDir := filepath.Join(installDir, filepath.FromSlash(loaderDllPath))
 
 	// check that the loader dll is present in the build dir
 	// e.g. at \tmp\app\dynatrace\oneagent\agent\bin\1.303.0.20240930-081133\windows-x86-32\oneagentloader.dll
-	loaderDllPathInBuildDir := filepath.Join(stager.BuildDir(), loaderDllPathInAppDir)
+	loaderDllPathInBuildDir := filepath.Join(installRoot(stager), loaderDllPathInAppDir)
 
 	if _, err = os.Stat(loaderDllPathInBuildDir); os.IsNotExist(err) {
 		h.Log.Error("Agent library (%s) not found!", loaderDllPathInBuildDir)
 		return "", err
 	}
 
-	// build the absolute path of the loader DLL as it will be available at runtime
-	return filepath.Join("C:\\users\\vcap\\app", loaderDllPathInAppDir), nil
+	// build the absolute path of the loader DLL as it will be available at runtime, with the windows path
+	// separator "\" instead of "/" even if we're staging on Linux
+	return "C:\\users\\vcap\\app\\" + strings.ReplaceAll(filepath.ToSlash(loaderDllPathInAppDir), "/", "\\"), nil
 }